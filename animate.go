@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const animationFrames = 48
+const animationFPS = 24
+
+// frameTime is the t a picture is evaluated at for frame i of n spread
+// evenly from 'from' to 'to'.
+func frameTime(i, n int, from, to float32) float32 {
+	if n <= 1 {
+		return from
+	}
+	return from + (to-from)*float32(i)/float32(n-1)
+}
+
+// renderFrames renders n frames of pic between times from and to, spreading
+// the work over every core.
+func renderFrames(pic *picture, w, h, n int, from, to float32) [][]byte {
+	scheduler := newRenderScheduler(runtime.NumCPU())
+	results := make(chan pixelResult, n)
+	for i := 0; i < n; i++ {
+		scheduler.submit(context.Background(), pic, w, h, frameTime(i, n, from, to), i, 0, false, results)
+	}
+
+	frames := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		result := <-results
+		frames[result.index] = result.pixels
+	}
+	return frames
+}
+
+func saveGIF(path string, frames [][]byte, w, h, delay int) error {
+	anim := &gif.GIF{}
+	bounds := image.Rect(0, 0, w, h)
+	for _, pixels := range frames {
+		paletted := image.NewPaletted(bounds, palette.Plan9)
+		draw.FloydSteinberg.Draw(paletted, bounds, pixelsToImage(pixels, w, h), image.Point{})
+		anim.Image = append(anim.Image, paletted)
+		anim.Delay = append(anim.Delay, delay)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = gif.EncodeAll(file, anim)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func animateCommand(args []string) error {
+	fs := flag.NewFlagSet("animate", flag.ExitOnError)
+	w := fs.Int("w", winWidth/2, "frame width in pixels")
+	h := fs.Int("h", winHeight/2, "frame height in pixels")
+	n := fs.Int("frames", animationFrames, "number of frames")
+	from := fs.Float64("from", -1, "time of the first frame")
+	to := fs.Float64("to", 1, "time of the last frame")
+	delay := fs.Int("delay", 100/animationFPS, "gif frame delay in 100ths of a second")
+	out := fs.String("o", "", "output .gif file, or a png name pattern such as frame%03d.png (default: input name with .gif extension)")
+	fs.Var(&nonFiniteColor, "nonfinite", "how NaN and infinite values are drawn: "+nonFiniteNames())
+	fs.BoolVar(&simplifyTrees, "simplify", simplifyTrees, "simplify trees before rendering and saving them, without changing how they look")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: evim animate in.apt [-w width] [-h height] [-frames n] [-from t] [-to t] [-o out.gif|frame%03d.png]")
+		fs.PrintDefaults()
+	}
+
+	inputs := parseInterspersed(fs, args)
+	if len(inputs) != 1 {
+		fs.Usage()
+		return errors.New("animate needs exactly one .apt file")
+	}
+	if *w <= 0 || *h <= 0 || *n <= 0 {
+		return fmt.Errorf("invalid animation size %dx%d with %d frames", *w, *h, *n)
+	}
+
+	in := inputs[0]
+	outPath := *out
+	if outPath == "" {
+		outPath = strings.TrimSuffix(in, filepath.Ext(in)) + ".gif"
+	}
+	isGIF := strings.EqualFold(filepath.Ext(outPath), ".gif")
+	if !isGIF && !strings.Contains(outPath, "%") {
+		return fmt.Errorf("%s: png output needs a frame number pattern such as frame%%03d.png", outPath)
+	}
+
+	pic, err := loadPicture(in)
+	if err != nil {
+		return err
+	}
+	frames := renderFrames(pic, *w, *h, *n, float32(*from), float32(*to))
+
+	if isGIF {
+		return saveGIF(outPath, frames, *w, *h, *delay)
+	}
+	for i, pixels := range frames {
+		if err := savePNG(fmt.Sprintf(outPath, i), pixels, *w, *h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/png"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	. "ast"
+)
+
+// loadTarget reads a reference image and scales it to w x h pixels in the
+// renderer's RGBA layout. If h is 0 it is picked to keep the aspect ratio.
+func loadTarget(path string, w, h int) ([]byte, int, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("%s: %v", path, err)
+	}
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return nil, 0, 0, fmt.Errorf("%s: empty image", path)
+	}
+	if h == 0 {
+		h = w * bounds.Dy() / bounds.Dx()
+		if h < 1 {
+			h = 1
+		}
+	}
+	return downsample(img, w, h), w, h, nil
+}
+
+// downsample scales img to w x h by averaging the pixels that fall into
+// each output pixel.
+func downsample(img image.Image, w, h int) []byte {
+	bounds := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	sw, sh := bounds.Dx(), bounds.Dy()
+
+	pixels := make([]byte, w*h*4)
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, (y+1)*sh/h
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, (x+1)*sw/w
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+			var sum [3]int
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					i := src.PixOffset(sx, sy)
+					sum[0] += int(src.Pix[i])
+					sum[1] += int(src.Pix[i+1])
+					sum[2] += int(src.Pix[i+2])
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			i := (y*w + x) * 4
+			pixels[i], pixels[i+1], pixels[i+2] = byte(sum[0]/n), byte(sum[1]/n), byte(sum[2]/n)
+		}
+	}
+	return pixels
+}
+
+// mse is the mean squared difference of the colors of two w x h pictures,
+// scaled to [0, 1].
+func mse(a, b []byte, w, h int) float64 {
+	sum := 0.0
+	for i := 0; i < w*h*4; i += 4 {
+		for c := 0; c < 3; c++ {
+			d := float64(a[i+c]) - float64(b[i+c])
+			sum += d * d
+		}
+	}
+	return sum / float64(w*h*3) / (255 * 255)
+}
+
+// ssimWindow is the size of the square windows ssim compares.
+const ssimWindow = 8
+
+// ssim is the mean structural similarity of the luminance of two w x h
+// pictures over non-overlapping windows. 1 means identical.
+func ssim(a, b []byte, w, h int) float64 {
+	const c1, c2 = (0.01 * 255) * (0.01 * 255), (0.03 * 255) * (0.03 * 255)
+	total, windows := 0.0, 0
+	for wy := 0; wy < h; wy += ssimWindow {
+		for wx := 0; wx < w; wx += ssimWindow {
+			var sumA, sumB, sumAA, sumBB, sumAB float64
+			n := 0
+			for y := wy; y < wy+ssimWindow && y < h; y++ {
+				for x := wx; x < wx+ssimWindow && x < w; x++ {
+					i := (y*w + x) * 4
+					la, lb := luminance(a, i), luminance(b, i)
+					sumA += la
+					sumB += lb
+					sumAA += la * la
+					sumBB += lb * lb
+					sumAB += la * lb
+					n++
+				}
+			}
+			fn := float64(n)
+			meanA, meanB := sumA/fn, sumB/fn
+			varA, varB := sumAA/fn-meanA*meanA, sumBB/fn-meanB*meanB
+			cov := sumAB/fn - meanA*meanB
+			total += (2*meanA*meanB + c1) * (2*cov + c2) / ((meanA*meanA + meanB*meanB + c1) * (varA + varB + c2))
+			windows++
+		}
+	}
+	return total / float64(windows)
+}
+
+// similarity scores how close pixels are to target, blending SSIM with the
+// root mean squared error. 1 means identical.
+func similarity(pixels, target []byte, w, h int, ssimWeight float64) float64 {
+	return ssimWeight*ssim(pixels, target, w, h) + (1-ssimWeight)*(1-math.Sqrt(mse(pixels, target, w, h)))
+}
+
+// climb hill-climbs the constants of p: each step nudges one constant and
+// keeps the change only if it brings p closer to target. It returns the
+// final score.
+func climb(rng *rand.Rand, scheduler *renderScheduler, p *picture, score float64, steps int, target []byte, w, h int, ssimWeight float64) float64 {
+	var constants []*OpConstant
+	for _, channel := range p.channels() {
+		constants = append(constants, Constants(*channel)...)
+	}
+	if len(constants) == 0 {
+		return score
+	}
+	improved := 0
+	for i := 0; i < steps; i++ {
+		c := constants[rng.Intn(len(constants))]
+		old := c.Value()
+		c.SetValue(old + float32(rng.NormFloat64()*JitterSigma))
+		if s := similarity(renderAll(scheduler, []*picture{p}, w, h)[0], target, w, h, ssimWeight); s > score {
+			score = s
+			improved++
+		} else {
+			c.SetValue(old)
+		}
+	}
+	if improved > 0 {
+		p.record("climb %d constants", improved)
+		p.finishLineage()
+	}
+	return score
+}
+
+// sideBySide puts two w x h pictures next to each other.
+func sideBySide(a, b []byte, w, h int) []byte {
+	pixels := make([]byte, w*2*h*4)
+	for y := 0; y < h; y++ {
+		copy(pixels[y*w*8:], a[y*w*4:(y+1)*w*4])
+		copy(pixels[y*w*8+w*4:], b[y*w*4:(y+1)*w*4])
+	}
+	return pixels
+}
+
+func approximateCommand(args []string) error {
+	fs := flag.NewFlagSet("approximate", flag.ExitOnError)
+	generations := fs.Int("generations", 200, "number of generations to breed")
+	fsRows := fs.Int("rows", rows, "rows of the population grid")
+	fsCols := fs.Int("cols", cols, "columns of the population grid")
+	tournamentSize := fs.Int("tournament", 3, "pictures competing for each parent slot")
+	size := fs.Int("size", 64, "width in pixels pictures are compared with the target at")
+	ssimWeight := fs.Float64("ssim", 0.5, "weight of SSIM against RMSE in the score, from 0 to 1")
+	climbs := fs.Int("climb", 2, "number of best pictures whose constants are hill-climbed each generation")
+	steps := fs.Int("steps", 20, "hill-climbing steps per picture")
+	every := fs.Int("every", 10, "save a progress image every this many generations, 0 for none")
+	progressW := fs.Int("w", 320, "width of the target and the best picture in progress images")
+	out := fs.String("o", "", "output directory (default: target name with _approx suffix)")
+	seedFlag := fs.Int64("seed", 0, "seed for the run's random numbers (default: from the clock)")
+	settings := addEvolutionFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: evim approximate target.png [-generations n] [-o dir] [flags]")
+		fs.PrintDefaults()
+	}
+
+	inputs := parseInterspersed(fs, args)
+	if len(inputs) != 1 {
+		fs.Usage()
+		return errors.New("approximate needs exactly one target image")
+	}
+	if *generations < 0 || *fsRows < 1 || *fsCols < 1 || *tournamentSize < 1 || *size <= 0 ||
+		*ssimWeight < 0 || *ssimWeight > 1 || *climbs < 0 || *steps < 0 || *every < 0 || *progressW <= 0 {
+		return errors.New("invalid approximate settings")
+	}
+	_, _, strategy, err := settings.apply()
+	if err != nil {
+		return err
+	}
+
+	in := inputs[0]
+	dir := *out
+	if dir == "" {
+		dir = strings.TrimSuffix(in, filepath.Ext(in)) + "_approx"
+	}
+	target, w, h, err := loadTarget(in, *size, 0)
+	if err != nil {
+		return err
+	}
+	progressTarget, pw, ph, err := loadTarget(in, *progressW, 0)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	seed := runSeed(fs, *seedFlag)
+	fmt.Println("seed", seed)
+	rows, cols, numPics = *fsRows, *fsCols, *fsRows**fsCols
+	if *climbs > numPics {
+		*climbs = numPics
+	}
+	rng := generationRand(seed, 0)
+	pics := make([]*picture, numPics)
+	for i := range pics {
+		pics[i] = NewPicture(rng)
+	}
+
+	scheduler := newRenderScheduler(runtime.NumCPU())
+	var best *picture
+	bestScore := math.Inf(-1)
+	for generation := 0; ; generation++ {
+		// The climbing and the breeding of the next generation draw from
+		// that generation's random source.
+		rng := generationRand(seed, generation+1)
+		scores := make([]float64, len(pics))
+		for i, pixels := range renderAll(scheduler, pics, w, h) {
+			scores[i] = similarity(pixels, target, w, h, *ssimWeight)
+		}
+		order := make([]int, len(pics))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool { return scores[order[i]] > scores[order[j]] })
+		for _, i := range order[:*climbs] {
+			scores[i] = climb(rng, scheduler, pics[i], scores[i], *steps, target, w, h, *ssimWeight)
+		}
+
+		leader := order[0]
+		for _, i := range order[:*climbs] {
+			if scores[i] > scores[leader] {
+				leader = i
+			}
+		}
+		if scores[leader] > bestScore {
+			best, bestScore = pics[leader], scores[leader]
+			if err := ioutil.WriteFile(filepath.Join(dir, "best.apt"), []byte(best.simplified().String()), 0644); err != nil {
+				return err
+			}
+			if best.lineage != nil {
+				if err := saveGenealogy(filepath.Join(dir, "best.lineage"), genealogyOf(best, seed)); err != nil {
+					return err
+				}
+			}
+		}
+		fmt.Printf("generation %d: best %.4f\n", generation, bestScore)
+		if *every > 0 && (generation%*every == 0 || generation == *generations) {
+			progress := sideBySide(progressTarget, renderAll(scheduler, []*picture{best}, pw, ph)[0], pw, ph)
+			name := filepath.Join(dir, fmt.Sprintf("progress%04d.png", generation))
+			if err := savePNG(name, progress, pw*2, ph); err != nil {
+				return err
+			}
+		}
+
+		if generation == *generations {
+			break
+		}
+		pics = evolve(rng, pickParents(rng, pics, scores, *tournamentSize), nil, generation+1, strategy)
+		// The best picture so far always survives, so the hill-climbing
+		// done on it is never lost.
+		pics[0] = carryOver(rng, best, generation+1)
+		pruneLineage(pics)
+	}
+
+	// The final render keeps the target's resolution; the tree itself can
+	// be rendered at any size with evim render.
+	bounds, err := imageSize(in)
+	if err != nil {
+		return err
+	}
+	return savePNG(filepath.Join(dir, "best.png"), renderAll(scheduler, []*picture{best}, bounds.X, bounds.Y)[0], bounds.X, bounds.Y)
+}
+
+func imageSize(path string) (image.Point, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return image.Point{}, err
+	}
+	defer file.Close()
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return image.Point{}, err
+	}
+	return image.Point{config.Width, config.Height}, nil
+}
@@ -1,17 +1,15 @@
 package ast
 
 import (
-	"math"
 	"math/rand"
 	"reflect"
 	"strconv"
-	noise "github.com/Go_Projects/simplex_noise"
 )
 
 type Node interface {
-	Eval(x, y float32) float32
+	Eval(x, y, t float32) float32
 	String() string
-	AddRandom(node Node)
+	AddRandom(rng *rand.Rand, node Node)
 	SetParent(parent Node)
 	AddLeaf(leaf Node) bool
 	NodeCount() int
@@ -25,28 +23,108 @@ type BaseNode struct {
 	Children []Node
 }
 
+// ColorSpace says how the three channel trees of a picture are turned into
+// a color.
+type ColorSpace int
+
+const (
+	RGB ColorSpace = iota
+	HSV
+	HSL
+	Lab
+	Gray // only the first tree is used
+	NumColorSpaces
+)
+
+var colorSpaceNames = [NumColorSpaces]string{"RGB", "HSV", "HSL", "Lab", "Gray"}
+
+func (c ColorSpace) String() string {
+	return colorSpaceNames[c]
+}
+
+func ParseColorSpace(s string) (ColorSpace, bool) {
+	for i, name := range colorSpaceNames {
+		if name == s {
+			return ColorSpace(i), true
+		}
+	}
+	return RGB, false
+}
+
 type OpPicture struct {
 	BaseNode
+	Space ColorSpace
+	Mode  Mode
 }
 
 func NewOpPicture() *OpPicture {
-	return &OpPicture{BaseNode{nil, make([]Node, 3)}}
+	return &OpPicture{BaseNode{nil, make([]Node, 3)}, RGB, Standard}
 }
 
-func (op *OpPicture) Eval(x, y float32) float32 {
+func (op *OpPicture) Eval(x, y, t float32) float32 {
 	panic("eval called on root of a picture tree")
 }
 
 func (op *OpPicture) String() string {
-	return "( Picture\n" + op.Children[0].String() + "\n" + op.Children[1].String() + "\n" + op.Children[2].String() + " )"
+	header := "( Picture"
+	if op.Space != RGB {
+		header += " " + op.Space.String()
+	}
+	if op.Mode != Standard {
+		header += " " + op.Mode.String()
+	}
+	return header + "\n" + op.Children[0].String() + "\n" + op.Children[1].String() + "\n" + op.Children[2].String() + " )"
 }
 
-func CopyTree(node Node, parent Node) Node {
-	copy := reflect.New(reflect.ValueOf(node).Elem().Type()).Interface().(Node)
+// GradientStop is one color of a palette picture's gradient. Pos is in
+// [0, 1].
+type GradientStop struct {
+	Pos     float32
+	R, G, B byte
+}
 
+func (s GradientStop) String() string {
+	return "( Stop " + strconv.FormatFloat(float64(s.Pos), 'f', 9, 32) + " " +
+		strconv.Itoa(int(s.R)) + " " + strconv.Itoa(int(s.G)) + " " + strconv.Itoa(int(s.B)) + " )"
+}
+
+// OpPalette is the root of a palette picture: a single scalar tree whose
+// value is looked up in a gradient.
+type OpPalette struct {
+	BaseNode
+	Stops []GradientStop
+	Mode  Mode
+}
+
+func NewOpPalette() *OpPalette {
+	return &OpPalette{BaseNode{nil, make([]Node, 1)}, nil, Standard}
+}
+
+func (op *OpPalette) Eval(x, y, t float32) float32 {
+	panic("eval called on root of a palette tree")
+}
+
+func (op *OpPalette) String() string {
+	s := "( Palette"
+	if op.Mode != Standard {
+		s += " " + op.Mode.String()
+	}
+	s += "\n"
+	for _, stop := range op.Stops {
+		s += stop.String() + "\n"
+	}
+	return s + op.Children[0].String() + " )"
+}
+
+func CopyTree(node Node, parent Node) Node {
+	var copy Node
 	switch n := node.(type) {
+	case *OpFunc:
+		copy = NewOp(n.Op)
 	case *OpConstant:
-		copy.(*OpConstant).value = n.value
+		copy = &OpConstant{value: n.value}
+	default:
+		copy = reflect.New(reflect.ValueOf(node).Elem().Type()).Interface().(Node)
 	}
 
 	copy.SetParent(parent)
@@ -97,15 +175,16 @@ func (node *BaseNode) GetParent() Node {
 	return node.Parent
 }
 
-func Mutate(node Node) Node {
-	r := rand.Intn(24)
-
+// Mutate replaces node with a random op or leaf drawn from rng, keeping as
+// many of its children as the new node takes. The active op set decides
+// how likely an op is.
+func Mutate(rng *rand.Rand, node Node) Node {
 	var mutatedNode Node
 
-	if r <= 21 {
-		mutatedNode = GetRandomBaseNode()
+	if rng.Float64() < activeOps.OpChance {
+		mutatedNode = GetRandomBaseNode(rng)
 	} else {
-		mutatedNode = GetRandomLeaf()
+		mutatedNode = GetRandomLeaf(rng)
 	}
 
 	if node.GetParent() != nil {
@@ -126,7 +205,7 @@ func Mutate(node Node) Node {
 
 	for i, child := range mutatedNode.GetChildren() {
 		if child == nil {
-			leaf := GetRandomLeaf()
+			leaf := GetRandomLeaf(rng)
 			leaf.SetParent(mutatedNode)
 			mutatedNode.GetChildren()[i] = leaf
 		}
@@ -145,7 +224,7 @@ func (node *BaseNode) NodeCount() int {
 	return count
 }
 
-func (node *BaseNode) Eval(x, y float32) float32 {
+func (node *BaseNode) Eval(x, y, t float32) float32 {
 	panic("tried to call evall on basenode")
 }
 
@@ -157,14 +236,14 @@ func (node *BaseNode) SetParent(parent Node) {
 	node.Parent = parent
 }
 
-func (node *BaseNode) AddRandom(nodeToAdd Node) {
-	addIndex := rand.Intn(len(node.Children))
+func (node *BaseNode) AddRandom(rng *rand.Rand, nodeToAdd Node) {
+	addIndex := rng.Intn(len(node.Children))
 
 	if node.Children[addIndex] == nil {
 		nodeToAdd.SetParent(node)
 		node.Children[addIndex] = nodeToAdd
 	} else {
-		node.Children[addIndex].AddRandom(nodeToAdd)
+		node.Children[addIndex].AddRandom(rng, nodeToAdd)
 	}
 }
 
@@ -181,103 +260,6 @@ func (node *BaseNode) AddLeaf(leaf Node) bool {
 	return false
 }
 
-type OpNegate struct {
-	BaseNode
-}
-
-func NewOpNegate() *OpNegate {
-	return &OpNegate{BaseNode{nil, make([]Node, 1)}}
-}
-
-func (op *OpNegate) Eval(x, y float32) float32 {
-	return -op.Children[0].Eval(x, y)
-}
-
-func (op *OpNegate) String() string {
-	return "( Negate " + op.Children[0].String() + " )"
-}
-
-type OpCeil struct {
-	BaseNode
-}
-
-func NewOpCeil() *OpCeil {
-	return &OpCeil{BaseNode{nil, make([]Node, 1)}}
-}
-
-func (op *OpCeil) Eval(x, y float32) float32 {
-
-	return float32(math.Ceil(float64(op.Children[0].Eval(x, y))))
-}
-
-func (op *OpCeil) String() string {
-	return "( Ceil " + op.Children[0].String() + " )"
-}
-
-type OpPlus struct {
-	BaseNode
-}
-
-func NewOpPlus() *OpPlus {
-	return &OpPlus{BaseNode{nil, make([]Node, 2)}}
-}
-
-func (op *OpPlus) Eval(x, y float32) float32 {
-	return op.Children[0].Eval(x, y) + op.Children[1].Eval(x, y)
-}
-
-func (op *OpPlus) String() string {
-	return "( + " + op.Children[0].String() + " " + op.Children[1].String() + " )"
-}
-
-type OpMinus struct {
-	BaseNode
-}
-
-func NewOpMinus() *OpMinus {
-	return &OpMinus{BaseNode{nil, make([]Node, 2)}}
-}
-
-func (op *OpMinus) Eval(x, y float32) float32 {
-	return op.Children[0].Eval(x, y) - op.Children[1].Eval(x, y)
-}
-
-func (op *OpMinus) String() string {
-	return "( - " + op.Children[0].String() + " " + op.Children[1].String() + " )"
-}
-
-type OpMult struct {
-	BaseNode
-}
-
-func NewOpMult() *OpMult {
-	return &OpMult{BaseNode{nil, make([]Node, 2)}}
-}
-
-func (op *OpMult) Eval(x, y float32) float32 {
-	return op.Children[0].Eval(x, y) * op.Children[1].Eval(x, y)
-}
-
-func (op *OpMult) String() string {
-	return "( * " + op.Children[0].String() + " " + op.Children[1].String() + " )"
-}
-
-type OpDiv struct {
-	BaseNode
-}
-
-func NewOpDiv() *OpDiv {
-	return &OpDiv{BaseNode{nil, make([]Node, 2)}}
-}
-
-func (op *OpDiv) Eval(x, y float32) float32 {
-	return op.Children[0].Eval(x, y) / op.Children[1].Eval(x, y)
-}
-
-func (op *OpDiv) String() string {
-	return "( / " + op.Children[0].String() + " " + op.Children[1].String() + " )"
-}
-
 type OpX struct {
 	BaseNode
 }
@@ -286,7 +268,7 @@ func NewOpX() *OpX {
 	return &OpX{BaseNode{nil, make([]Node, 0)}}
 }
 
-func (op *OpX) Eval(x, y float32) float32 {
+func (op *OpX) Eval(x, y, t float32) float32 {
 	return x
 }
 
@@ -302,7 +284,7 @@ func NewOpY() *OpY {
 	return &OpY{BaseNode{nil, make([]Node, 0)}}
 }
 
-func (op *OpY) Eval(x, y float32) float32 {
+func (op *OpY) Eval(x, y, t float32) float32 {
 	return y
 }
 
@@ -310,27 +292,20 @@ func (op *OpY) String() string {
 	return "Y"
 }
 
-type OpClip struct {
+type OpT struct {
 	BaseNode
 }
 
-func NewOpClip() *OpClip {
-	return &OpClip{BaseNode{nil, make([]Node, 2)}}
+func NewOpT() *OpT {
+	return &OpT{BaseNode{nil, make([]Node, 0)}}
 }
 
-func (op *OpClip) Eval(x, y float32) float32 {
-	value := op.Children[0].Eval(x, y)
-	max := float32(math.Abs(float64(op.Children[1].Eval(x, y))))
-	if value > max {
-		return max
-	} else if value < -max {
-		return -max
-	}
-	return value
+func (op *OpT) Eval(x, y, t float32) float32 {
+	return t
 }
 
-func (op *OpClip) String() string {
-	return "( Clip " + op.Children[0].String() + " " + op.Children[1].String() + " )"
+func (op *OpT) String() string {
+	return "T"
 }
 
 type OpConstant struct {
@@ -338,308 +313,60 @@ type OpConstant struct {
 	value float32
 }
 
-func NewOpConstant() *OpConstant {
-	return &OpConstant{BaseNode{nil, make([]Node, 0)}, rand.Float32()*2 - 1}
-}
-
-func (op *OpConstant) Eval(x, y float32) float32 {
-	return op.value
-}
-
-func (op *OpConstant) String() string {
-	return strconv.FormatFloat(float64(op.value), 'f', 9, 32)
-}
-
-type OpSquare struct {
-	BaseNode
-}
-
-func NewOpSquare() *OpSquare {
-	return &OpSquare{BaseNode{nil, make([]Node, 2)}}
-}
-
-func (op *OpSquare) Eval(x, y float32) float32 {
-	square := op.Children[0].Eval(x, y) * op.Children[1].Eval(x, y)
-
-	return square * square
-}
-
-func (op *OpSquare) String() string {
-	return "( Square " + op.Children[0].String() + " " + op.Children[1].String() + " )"
-}
-
-type OpLerp struct {
-	BaseNode
-}
-
-func NewOpLerp() *OpLerp {
-	return &OpLerp{BaseNode{nil, make([]Node, 3)}}
-}
-
-func (op *OpLerp) Eval(x, y float32) float32 {
-	a := op.Children[0].Eval(x, y)
-	b := op.Children[1].Eval(x, y)
-	p := op.Children[2].Eval(x, y)
-
-	return a + p*(b-a)
-}
-
-func (op *OpLerp) String() string {
-	return "( Lerp " + op.Children[0].String() + " " + op.Children[1].String() + " " + op.Children[2].String() + " )"
-}
-
-type OpSin struct {
-	BaseNode
-}
-
-func NewOpSin() *OpSin {
-	return &OpSin{BaseNode{nil, make([]Node, 1)}}
-}
-
-func (op *OpSin) Eval(x, y float32) float32 {
-	return float32(math.Sin(float64(op.Children[0].Eval(x, y))))
-}
-
-func (op *OpSin) String() string {
-	return "( Sin " + op.Children[0].String() + " )"
-}
-
-type OpCos struct {
-	BaseNode
-}
-
-func NewOpCos() *OpCos {
-	return &OpCos{BaseNode{nil, make([]Node, 1)}}
-}
-
-func (op *OpCos) Eval(x, y float32) float32 {
-	return float32(math.Cos(float64(op.Children[0].Eval(x, y))))
-}
-
-func (op *OpCos) String() string {
-	return "( Cos " + op.Children[0].String() + " )"
-}
-
-type OpFloor struct {
-	BaseNode
-}
-
-func NewOpFloor() *OpFloor {
-	return &OpFloor{BaseNode{nil, make([]Node, 1)}}
-}
-
-func (op *OpFloor) Eval(x, y float32) float32 {
-	return float32(math.Floor(float64(op.Children[0].Eval(x, y))))
-}
-
-func (op *OpFloor) String() string {
-	return "( Floor " + op.Children[0].String() + " )"
+func NewOpConstant(rng *rand.Rand) *OpConstant {
+	return &OpConstant{BaseNode{nil, make([]Node, 0)}, rng.Float32()*2 - 1}
 }
 
-type OpLog struct {
-	BaseNode
-}
-
-func NewOpLog() *OpLog {
-	return &OpLog{BaseNode{nil, make([]Node, 1)}}
-}
-
-func (op *OpLog) Eval(x, y float32) float32 {
-	return float32(math.Log2(float64(op.Children[0].Eval(x, y))))
-}
-
-func (op *OpLog) String() string {
-	return "( Log " + op.Children[0].String() + " )"
-}
-
-type OpWrap struct {
-	BaseNode
-}
-
-func NewOpWrap() *OpWrap {
-	return &OpWrap{BaseNode{nil, make([]Node, 1)}}
-}
-
-func (op *OpWrap) Eval(x, y float32) float32 {
-	f := op.Children[0].Eval(x, y)
-	temp := (f - 1.0) / 2.0
-	return -1.0 + 2.0*(temp-float32(math.Floor(float64(temp))))
-}
-
-func (op *OpWrap) String() string {
-	return "(Wrap " + op.Children[0].String() + ")"
-}
-
-type OpAbs struct {
-	BaseNode
-}
-
-func NewOpAbs() *OpAbs {
-	return &OpAbs{BaseNode{nil, make([]Node, 1)}}
-}
-
-func (op *OpAbs) Eval(x, y float32) float32 {
-	return float32(math.Abs(float64(op.Children[0].Eval(x, y))))
-}
-
-func (op *OpAbs) String() string {
-	return "( Abs " + op.Children[0].String() + " )"
-}
-
-type OpAtan struct {
-	BaseNode
+// NewConstant returns a constant leaf with the given value.
+func NewConstant(value float32) *OpConstant {
+	return &OpConstant{BaseNode{nil, make([]Node, 0)}, value}
 }
 
-func NewOpAtan() *OpAtan {
-	return &OpAtan{BaseNode{nil, make([]Node, 1)}}
-}
-
-func (op *OpAtan) Eval(x, y float32) float32 {
-	return float32(math.Atan(float64(op.Children[0].Eval(x, y))))
-}
-
-func (op *OpAtan) String() string {
-	return "( Atan " + op.Children[0].String() + " )"
-}
-
-type OpNoise struct {
-	BaseNode
-}
-
-func NewOpNoise() *OpNoise {
-	return &OpNoise{BaseNode{nil, make([]Node, 2)}}
-}
-
-func (op *OpNoise) Eval(x, y float32) float32 {
-	return 80*noise.Snoise2(op.Children[0].Eval(x, y), op.Children[1].Eval(x, y)) - 2.0
-}
-
-func (op *OpNoise) String() string {
-	return "( Noise " + op.Children[0].String() + " " + op.Children[1].String() + " )"
-}
-
-type OpFBM struct {
-	BaseNode
-}
-
-func NewOpFBM() *OpFBM {
-	return &OpFBM{BaseNode{nil, make([]Node, 3)}}
-}
-
-func (op *OpFBM) Eval(x, y float32) float32 {
-	return 2*3.627*noise.Fbm(op.Children[0].Eval(x, y), op.Children[1].Eval(x, y), 5*op.Children[2].Eval(x, y), 0.5, 2, 3) + .492 - 1
-}
-
-func (op *OpFBM) String() string {
-	return "( FBM " + op.Children[0].String() + " " + op.Children[1].String() + " " + op.Children[2].String() + " )"
-}
-
-type OpTurbulence struct {
-	BaseNode
-}
-
-func NewOpTurbulence() *OpTurbulence {
-	return &OpTurbulence{BaseNode{nil, make([]Node, 3)}}
-}
-
-func (op *OpTurbulence) Eval(x, y float32) float32 {
-	return 2*6.96*noise.Turbulence(op.Children[0].Eval(x, y), op.Children[1].Eval(x, y), 5*op.Children[2].Eval(x, y), 0.5, 2, 3) - 1
-}
-
-func (op *OpTurbulence) String() string {
-	return "( Turbulence " + op.Children[0].String() + " " + op.Children[1].String() + " " + op.Children[2].String() + " )"
-}
-
-type OpGamma struct {
-	BaseNode
-}
-
-func NewOpGamma() *OpGamma {
-	return &OpGamma{BaseNode{nil, make([]Node, 1)}}
-}
-
-func (op *OpGamma) Eval(x, y float32) float32 {
-	return float32(math.Gamma(float64(op.Children[0].Eval(x, y))))
-}
-
-func (op *OpGamma) String() string {
-	return "( Gamma " + op.Children[0].String() + " )"
+func (op *OpConstant) Eval(x, y, t float32) float32 {
+	return op.value
 }
 
-type OpHypot struct {
-	BaseNode
+func (op *OpConstant) Value() float32 {
+	return op.value
 }
 
-func NewOpHypot() *OpHypot {
-	return &OpHypot{BaseNode{nil, make([]Node, 2)}}
+func (op *OpConstant) SetValue(value float32) {
+	op.value = value
 }
 
-func (op *OpHypot) Eval(x, y float32) float32 {
-	return float32(math.Hypot(float64(op.Children[0].Eval(x, y)), float64(op.Children[1].Eval(x, y))))
+// Constants returns every constant in the tree under node.
+func Constants(node Node) []*OpConstant {
+	if constant, ok := node.(*OpConstant); ok {
+		return []*OpConstant{constant}
+	}
+	var constants []*OpConstant
+	for _, child := range node.GetChildren() {
+		constants = append(constants, Constants(child)...)
+	}
+	return constants
 }
 
-func (op *OpHypot) String() string {
-	return "( Hypot " + op.Children[0].String() + " " + op.Children[1].String() + " )"
+func (op *OpConstant) String() string {
+	return strconv.FormatFloat(float64(op.value), 'f', 9, 32)
 }
 
-func GetRandomBaseNode() Node {
-	r := rand.Intn(21)
-	switch r {
-	case 0:
-		return NewOpClip()
-	case 1:
-		return NewOpNegate()
-	case 2:
-		return NewOpMult()
-	case 3:
-		return NewOpPlus()
-	case 4:
-		return NewOpCeil()
-	case 5:
-		return NewOpMinus()
-	case 6:
-		return NewOpDiv()
-	case 7:
-		return NewOpSquare()
-	case 8:
-		return NewOpLerp()
-	case 9:
-		return NewOpSin()
-	case 10:
-		return NewOpCos()
-	case 11:
-		return NewOpFloor()
-	case 12:
-		return NewOpLog()
-	case 13:
-		return NewOpWrap()
-	case 14:
-		return NewOpAbs()
-	case 15:
-		return NewOpAtan()
-	case 16:
-		return NewOpNoise()
-	case 17:
-		return NewOpFBM()
-	case 18:
-		return NewOpTurbulence()
-	case 19:
-		return NewOpGamma()
-	case 20:
-		return NewOpHypot()
-	}
-	panic("Get Random Double Node Failed!")
+// GetRandomBaseNode returns a new op picked from the registered operators
+// according to the active op set.
+func GetRandomBaseNode(rng *rand.Rand) Node {
+	return NewOp(pickOperator(rng))
 }
 
-func GetRandomLeaf() Node {
-	r := rand.Intn(3)
+func GetRandomLeaf(rng *rand.Rand) Node {
+	r := rng.Intn(4)
 	switch r {
 	case 0:
-		return NewOpConstant()
+		return NewOpConstant(rng)
 	case 1:
 		return NewOpX()
 	case 2:
 		return NewOpY()
+	case 3:
+		return NewOpT()
 	}
 	panic("Get Leaf Node Failed!")
 }
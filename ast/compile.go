@@ -0,0 +1,168 @@
+package ast
+
+type opcode uint8
+
+// Leaves get their own opcodes. Every op runs as opCall, through the
+// functions of its Operator.
+const (
+	opCall opcode = iota
+	opX
+	opY
+	opT
+	opConstant
+)
+
+type instruction struct {
+	op    opcode
+	value float32
+	arity int
+	eval  func(a, b, c float32) float32
+	row   func(a, b, c []float32)
+}
+
+// Program is a channel tree flattened into postfix order. Evaluating a
+// program compiled in Standard mode produces the same value as calling Eval
+// on the tree it was compiled from, without the recursion and interface
+// calls.
+type Program struct {
+	code      []instruction
+	stackSize int
+	mode      Mode
+}
+
+// Compile lowers a channel tree into a Program that evaluates its ops in
+// the given mode. Eval on the tree itself always uses Standard mode.
+func Compile(node Node, mode Mode) *Program {
+	p := &Program{mode: mode}
+	p.stackSize = p.emit(node, 0)
+	return p
+}
+
+// emit appends the instructions for node and returns the stack depth needed
+// to evaluate it, given depth values are already on the stack.
+func (p *Program) emit(node Node, depth int) int {
+	maxDepth := depth
+	for i, child := range node.GetChildren() {
+		if d := p.emit(child, depth+i); d > maxDepth {
+			maxDepth = d
+		}
+	}
+
+	var ins instruction
+	switch n := node.(type) {
+	case *OpX:
+		ins.op = opX
+	case *OpY:
+		ins.op = opY
+	case *OpT:
+		ins.op = opT
+	case *OpConstant:
+		ins.op = opConstant
+		ins.value = n.value
+	case *OpFunc:
+		ins.op = opCall
+		ins.arity = n.Op.Arity
+		ins.eval, ins.row = n.Op.Eval, n.Op.row
+		if p.mode == Protected {
+			ins.eval, ins.row = n.Op.Protected, n.Op.protectedRow
+		}
+	default:
+		panic("compile: unsupported node " + node.String())
+	}
+	p.code = append(p.code, ins)
+
+	if depth+1 > maxDepth {
+		maxDepth = depth + 1
+	}
+	return maxDepth
+}
+
+// StackSize is the number of values Eval needs in its stack argument.
+func (p *Program) StackSize() int {
+	return p.stackSize
+}
+
+// NewStack allocates a stack large enough to evaluate p. Reuse it across
+// calls to Eval; a stack must not be shared between goroutines.
+func (p *Program) NewStack() []float32 {
+	return make([]float32, p.stackSize)
+}
+
+// Eval runs the program at (x, y) and time t using stack as scratch space.
+func (p *Program) Eval(stack []float32, x, y, t float32) float32 {
+	sp := 0
+	code := p.code
+	for i := range code {
+		ins := &code[i]
+		switch ins.op {
+		case opCall:
+			var args [MaxArity]float32
+			sp -= ins.arity
+			copy(args[:], stack[sp:sp+ins.arity])
+			stack[sp] = ins.eval(args[0], args[1], args[2])
+			sp++
+		case opX:
+			stack[sp] = x
+			sp++
+		case opY:
+			stack[sp] = y
+			sp++
+		case opT:
+			stack[sp] = t
+			sp++
+		case opConstant:
+			stack[sp] = ins.value
+			sp++
+		}
+	}
+	return stack[0]
+}
+
+// NewRowStack allocates scratch space for EvalRow on rows of up to width
+// pixels. Like NewStack, it must not be shared between goroutines.
+func (p *Program) NewRowStack(width int) [][]float32 {
+	stack := make([][]float32, p.stackSize)
+	for i := range stack {
+		stack[i] = make([]float32, width)
+	}
+	return stack
+}
+
+// EvalRow evaluates the program for every x in xs at the same y and t and writes
+// the results to out. Running each instruction over the whole row amortises
+// the dispatch cost, which makes it considerably faster than calling Eval
+// once per pixel.
+func (p *Program) EvalRow(stack [][]float32, xs []float32, y, t float32, out []float32) {
+	n := len(xs)
+	sp := 0
+	code := p.code
+	for i := range code {
+		ins := &code[i]
+		switch ins.op {
+		case opCall:
+			var args [MaxArity][]float32
+			sp -= ins.arity
+			for k := range args[:ins.arity] {
+				args[k] = stack[sp+k][:n]
+			}
+			ins.row(args[0], args[1], args[2])
+			sp++
+		case opX:
+			copy(stack[sp][:n], xs)
+			sp++
+		case opY, opT, opConstant:
+			v := y
+			if ins.op == opT {
+				v = t
+			} else if ins.op == opConstant {
+				v = ins.value
+			}
+			dst := stack[sp][:n]
+			for j := range dst {
+				dst[j] = v
+			}
+			sp++
+		}
+	}
+	copy(out[:n], stack[0][:n])
+}
@@ -0,0 +1,228 @@
+package ast
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+var (
+	nan     = float32(math.NaN())
+	posInf  = float32(math.Inf(1))
+	negInf  = float32(math.Inf(-1))
+	negZero = float32(math.Copysign(0, -1))
+)
+
+// testLeaves are the children the op tests are built from: the coordinates
+// and constants at and around the singularities of the built in ops.
+func testLeaves() []Node {
+	leaves := []Node{NewOpX(), NewOpY(), NewOpT()}
+	for _, v := range []float32{0, negZero, 1, -1, 0.5, -2, 3.7, 1e30, -1e30, posInf, negInf, nan} {
+		leaves = append(leaves, NewConstant(v))
+	}
+	return leaves
+}
+
+// testXs, testYs and testTs are the points trees are evaluated at.
+var (
+	testXs = []float32{-1, -0.5, negZero, 0, 0.25, 0.73, 1}
+	testYs = []float32{-1, 0, 0.31, 1}
+	testTs = []float32{-1, 0, 0.5}
+)
+
+// withChildren returns an op node for op with copies of children.
+func withChildren(op *Operator, children ...Node) Node {
+	node := NewOp(op)
+	for i, child := range children {
+		node.Children[i] = CopyTree(child, node)
+	}
+	return node
+}
+
+// childCombinations calls f with every way of picking arity children from
+// leaves.
+func childCombinations(leaves []Node, arity int, f func([]Node)) {
+	picked := make([]Node, arity)
+	var pick func(int)
+	pick = func(i int) {
+		if i == arity {
+			f(picked)
+			return
+		}
+		for _, leaf := range leaves {
+			picked[i] = leaf
+			pick(i + 1)
+		}
+	}
+	pick(0)
+}
+
+// sameValue reports whether a and b have the same bits, so -0 differs from
+// 0, or are both NaN. Which NaN an operation on NaNs gives depends on the
+// order the compiler puts its operands in, and nothing looks at it.
+func sameValue(a, b float32) bool {
+	return math.Float32bits(a) == math.Float32bits(b) || a != a && b != b
+}
+
+// checkCompiled compares Program.Eval and Program.EvalRow of node, compiled
+// in Standard mode, with node.Eval bit for bit.
+func checkCompiled(t *testing.T, node Node) {
+	t.Helper()
+	program := Compile(node, Standard)
+	stack := program.NewStack()
+	rowStack := program.NewRowStack(len(testXs))
+	row := make([]float32, len(testXs))
+	for _, ty := range testTs {
+		for _, y := range testYs {
+			program.EvalRow(rowStack, testXs, y, ty, row)
+			for i, x := range testXs {
+				want := node.Eval(x, y, ty)
+				if got := program.Eval(stack, x, y, ty); !sameValue(got, want) {
+					t.Fatalf("%s at (%v, %v, %v): Eval gives %v, want %v", node, x, y, ty, got, want)
+				}
+				if got := row[i]; !sameValue(got, want) {
+					t.Fatalf("%s at (%v, %v, %v): EvalRow gives %v, want %v", node, x, y, ty, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestCompileLeaves(t *testing.T) {
+	for _, leaf := range testLeaves() {
+		checkCompiled(t, leaf)
+	}
+}
+
+func TestCompileOperators(t *testing.T) {
+	leaves := testLeaves()
+	for _, op := range Operators() {
+		t.Run(op.Name, func(t *testing.T) {
+			childCombinations(leaves, op.Arity, func(children []Node) {
+				checkCompiled(t, withChildren(op, children...))
+			})
+		})
+	}
+}
+
+func TestCompileCustomOperator(t *testing.T) {
+	// Registered ops run as opCall, which takes a different path through
+	// both evaluation loops than the built in ones.
+	op := Lookup("TestMix")
+	if op == nil {
+		op = &Operator{Name: "TestMix", Arity: 3, Eval: func(a, b, c float32) float32 {
+			return a*b - c
+		}}
+		Register(op)
+	}
+	childCombinations(testLeaves(), op.Arity, func(children []Node) {
+		checkCompiled(t, withChildren(op, children...))
+	})
+}
+
+// testValues are the arguments every op is checked with.
+var testValues = []float32{0, negZero, 1, -1, 0.5, -0.5, 2, -2, 3.7, -7.25, 100, 1e-30, 1e30, -1e30, posInf, negInf, nan}
+
+// argValues gives the values to try for op's argument i, or a single
+// value when op does not take it.
+func argValues(op *Operator, i int) []float32 {
+	if i < op.Arity {
+		return testValues
+	}
+	return []float32{0}
+}
+
+func TestCompiledOps(t *testing.T) {
+	for _, op := range Operators() {
+		// X, Y and T are the arguments, so each row covers every value of
+		// the first with one of the rest.
+		node := withChildren(op, []Node{NewOpX(), NewOpY(), NewOpT()}[:op.Arity]...)
+		for _, mode := range []Mode{Standard, Protected} {
+			eval := op.Eval
+			if mode == Protected {
+				eval = op.Protected
+			}
+			program := Compile(node, mode)
+			stack, rowStack := program.NewStack(), program.NewRowStack(len(testValues))
+			row := make([]float32, len(testValues))
+			for _, y := range argValues(op, 1) {
+				for _, ty := range argValues(op, 2) {
+					program.EvalRow(rowStack, testValues, y, ty, row)
+					for i, x := range testValues {
+						want := eval(x, y, ty)
+						if got := program.Eval(stack, x, y, ty); !sameValue(got, want) {
+							t.Errorf("%s in %s mode: Eval gives %v at (%v, %v, %v), want %v", node, mode, got, x, y, ty, want)
+						}
+						if !sameValue(row[i], want) {
+							t.Errorf("%s in %s mode: EvalRow gives %v at (%v, %v, %v), want %v", node, mode, row[i], x, y, ty, want)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestCompileRandomTrees(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		checkCompiled(t, RandomTree(rng, 30))
+	}
+}
+
+func TestCompilePictures(t *testing.T) {
+	for _, src := range []string{
+		"( Picture\n( + X ( Sin Y ) )\n( / T ( - X Y ) )\n( FBM X Y T ) )",
+		"( Picture Lab Protected\n( Log X )\n( Gamma ( * 4.000000000 Y ) )\n( Square X 100000000000000000000.000000000 ) )",
+		"( Palette\n( Stop 0.000000000 0 0 0 )\n( Stop 1.000000000 255 128 0 )\n( Noise ( Wrap X ) ( Atan Y ) ) )",
+		"( Palette Protected\n( Stop 0.500000000 10 20 30 )\n( Stop 0.750000000 200 100 0 )\n( Hypot ( / X Y ) ( Turbulence X Y T ) ) )",
+	} {
+		root, err := BeginLexing(src)
+		if err != nil {
+			t.Fatalf("%q: %v", src, err)
+		}
+		for _, channel := range root.GetChildren() {
+			checkCompiled(t, channel)
+		}
+	}
+}
+
+// BenchmarkASTToPixels renders a set of random trees at thumbnail size by
+// walking the trees and by running the compiled programs row by row.
+func BenchmarkASTToPixels(b *testing.B) {
+	const w, h = 128, 72
+	rng := rand.New(rand.NewSource(1))
+	trees := make([]Node, 16)
+	for i := range trees {
+		trees[i] = RandomTree(rng, 30)
+	}
+	xs := make([]float32, w)
+	for xi := range xs {
+		xs[xi] = float32(xi)/w*2 - 1
+	}
+	out := make([]float32, w)
+
+	b.Run("tree", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for _, tree := range trees {
+				for yi := 0; yi < h; yi++ {
+					y := float32(yi)/h*2 - 1
+					for xi, x := range xs {
+						out[xi] = tree.Eval(x, y, 0)
+					}
+				}
+			}
+		}
+	})
+	b.Run("compiled", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for _, tree := range trees {
+				program := Compile(tree, Standard)
+				stack := program.NewRowStack(w)
+				for yi := 0; yi < h; yi++ {
+					program.EvalRow(stack, xs, float32(yi)/h*2-1, 0, out)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,58 @@
+package ast
+
+import "math/rand"
+
+// Depth returns the number of nodes on the longest path from node down to
+// a leaf. A single leaf has depth 1.
+func Depth(node Node) int {
+	depth := 0
+	for _, child := range node.GetChildren() {
+		if d := Depth(child); d > depth {
+			depth = d
+		}
+	}
+	return depth + 1
+}
+
+// Level returns how many ancestors node has.
+func Level(node Node) int {
+	level := 0
+	for parent := node.GetParent(); parent != nil; parent = parent.GetParent() {
+		level++
+	}
+	return level
+}
+
+// TrimDepth replaces every op at depth maxDepth with a random leaf, so the
+// tree is at most maxDepth deep. It returns the new root, which only
+// differs from node when maxDepth is 1.
+func TrimDepth(rng *rand.Rand, node Node, maxDepth int) Node {
+	if len(node.GetChildren()) == 0 {
+		return node
+	}
+	if maxDepth <= 1 {
+		leaf := GetRandomLeaf(rng)
+		ReplaceNode(node, leaf)
+		return leaf
+	}
+	for _, child := range node.GetChildren() {
+		TrimDepth(rng, child, maxDepth-1)
+	}
+	return node
+}
+
+// Limit trims node until it is at most maxDepth deep and has at most
+// maxNodes nodes, cutting away the deepest parts first. A limit of 0 or
+// less is ignored. It returns the new root.
+func Limit(rng *rand.Rand, node Node, maxDepth, maxNodes int) Node {
+	depth := Depth(node)
+	if maxDepth > 0 && depth > maxDepth {
+		depth = maxDepth
+		node = TrimDepth(rng, node, depth)
+	}
+	for maxNodes > 0 && depth > 1 && node.NodeCount() > maxNodes {
+		depth--
+		node = TrimDepth(rng, node, depth)
+	}
+	return node
+}
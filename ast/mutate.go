@@ -0,0 +1,171 @@
+package ast
+
+import "math/rand"
+
+// A Mutation changes a channel tree. It returns the new root of the tree
+// and the preorder index of the node it changed, as used by GetNthNode. If
+// the tree has nothing the mutation applies to, ok is false and the tree
+// is left alone.
+type Mutation func(rng *rand.Rand, root Node) (newRoot Node, at int, ok bool)
+
+// JitterSigma is the standard deviation of the noise JitterConstant adds.
+var JitterSigma = 0.1
+
+// RandomTree grows a tree from a random op and up to maxOps-1 more, with
+// random leaves filling the free slots.
+func RandomTree(rng *rand.Rand, maxOps int) Node {
+	node := GetRandomBaseNode(rng)
+	num := rng.Intn(maxOps)
+	for i := 0; i < num; i++ {
+		node.AddRandom(rng, GetRandomBaseNode(rng))
+	}
+	for node.AddLeaf(GetRandomLeaf(rng)) {
+
+	}
+	return node
+}
+
+// pickNode returns a random node of root that satisfies keep along with its
+// preorder index, or nil if there is none.
+func pickNode(rng *rand.Rand, root Node, keep func(Node) bool) (Node, int) {
+	var nodes []Node
+	var indexes []int
+	count := 0
+	var walk func(Node)
+	walk = func(node Node) {
+		if keep(node) {
+			nodes = append(nodes, node)
+			indexes = append(indexes, count)
+		}
+		count++
+		for _, child := range node.GetChildren() {
+			walk(child)
+		}
+	}
+	walk(root)
+	if len(nodes) == 0 {
+		return nil, -1
+	}
+	i := rng.Intn(len(nodes))
+	return nodes[i], indexes[i]
+}
+
+func anyNode(Node) bool { return true }
+
+func isOp(node Node) bool { return len(node.GetChildren()) > 0 }
+
+// replace puts new in old's place and returns the root of the tree.
+func replace(root, old, new Node) Node {
+	ReplaceNode(old, new)
+	if old == root {
+		return new
+	}
+	return root
+}
+
+// PointMutation runs Mutate on a random node.
+func PointMutation(rng *rand.Rand, root Node) (Node, int, bool) {
+	r := rng.Intn(root.NodeCount())
+	node, _ := GetNthNode(root, r, 0)
+	mutated := Mutate(rng, node)
+	if node == root {
+		root = mutated
+	}
+	return root, r, true
+}
+
+// SameArityMutation swaps a random op for another of the same arity,
+// keeping its children, or a leaf for another leaf.
+func SameArityMutation(rng *rand.Rand, root Node) (Node, int, bool) {
+	node, at := pickNode(rng, root, anyNode)
+	children := node.GetChildren()
+	if len(children) == 0 {
+		return replace(root, node, GetRandomLeaf(rng)), at, true
+	}
+	op := pickOperatorWithArity(rng, len(children))
+	if op == nil {
+		return root, -1, false
+	}
+	mutated := NewOp(op)
+	for i, child := range children {
+		mutated.Children[i] = child
+		child.SetParent(mutated)
+	}
+	return replace(root, node, mutated), at, true
+}
+
+// JitterConstant adds Gaussian noise with deviation JitterSigma to a
+// random constant.
+func JitterConstant(rng *rand.Rand, root Node) (Node, int, bool) {
+	node, at := pickNode(rng, root, func(n Node) bool {
+		_, ok := n.(*OpConstant)
+		return ok
+	})
+	if node == nil {
+		return root, -1, false
+	}
+	node.(*OpConstant).value += float32(rng.NormFloat64() * JitterSigma)
+	return root, at, true
+}
+
+// ReplaceSubtree puts a small new random tree in place of a random node.
+func ReplaceSubtree(rng *rand.Rand, root Node) (Node, int, bool) {
+	node, at := pickNode(rng, root, anyNode)
+	return replace(root, node, RandomTree(rng, 4)), at, true
+}
+
+// Hoist makes a random subtree the whole tree.
+func Hoist(rng *rand.Rand, root Node) (Node, int, bool) {
+	node, at := pickNode(rng, root, func(n Node) bool { return n != root })
+	if node == nil {
+		return root, -1, false
+	}
+	node.SetParent(nil)
+	return node, at, true
+}
+
+// Shrink replaces a random op and everything below it with a leaf.
+func Shrink(rng *rand.Rand, root Node) (Node, int, bool) {
+	node, at := pickNode(rng, root, isOp)
+	if node == nil {
+		return root, -1, false
+	}
+	return replace(root, node, GetRandomLeaf(rng)), at, true
+}
+
+// Collapse replaces a random op with one of its children.
+func Collapse(rng *rand.Rand, root Node) (Node, int, bool) {
+	node, at := pickNode(rng, root, isOp)
+	if node == nil {
+		return root, -1, false
+	}
+	children := node.GetChildren()
+	return replace(root, node, children[rng.Intn(len(children))]), at, true
+}
+
+// Permute swaps two arguments of a random op that takes more than one.
+func Permute(rng *rand.Rand, root Node) (Node, int, bool) {
+	node, at := pickNode(rng, root, func(n Node) bool { return len(n.GetChildren()) > 1 })
+	if node == nil {
+		return root, -1, false
+	}
+	children := node.GetChildren()
+	i := rng.Intn(len(children))
+	j := (i + 1 + rng.Intn(len(children)-1)) % len(children)
+	children[i], children[j] = children[j], children[i]
+	return root, at, true
+}
+
+// WrapInUnary puts a random unary op above a random node.
+func WrapInUnary(rng *rand.Rand, root Node) (Node, int, bool) {
+	op := pickOperatorWithArity(rng, 1)
+	if op == nil {
+		return root, -1, false
+	}
+	node, at := pickNode(rng, root, anyNode)
+	wrapper := NewOp(op)
+	root = replace(root, node, wrapper)
+	wrapper.Children[0] = node
+	node.SetParent(wrapper)
+	return root, at, true
+}
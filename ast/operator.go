@@ -0,0 +1,474 @@
+package ast
+
+import (
+	"math"
+	"strings"
+
+	noise "github.com/Go_Projects/simplex_noise"
+)
+
+// MaxArity is the most children an operator can take.
+const MaxArity = 3
+
+// Operator describes one kind of op node. Everything that needs to know
+// about ops, from loading and saving trees to picking random ones during
+// evolution, goes through the registered operators.
+type Operator struct {
+	// Name is how the op is written in .apt files.
+	Name string
+	// Arity is the number of children, between 1 and MaxArity.
+	Arity int
+	// Eval computes the op from the values of its children. Arguments
+	// past Arity are zero.
+	Eval func(a, b, c float32) float32
+	// Protected replaces Eval in Protected mode and should return a
+	// finite value for any arguments. If it is nil, Register sets it to
+	// Eval with the result clamped to +-ProtectedLimit and 0 for NaN.
+	Protected func(a, b, c float32) float32
+
+	// row and protectedRow apply Eval and Protected to whole rows of
+	// values, leaving the results in a. Built in ops have loops the
+	// compiler can inline their math into; register fills in the rest
+	// with loops that call Eval or Protected, or clamp the results of row.
+	row, protectedRow func(a, b, c []float32)
+}
+
+// Mode says how a compiled tree treats the singularities of its ops.
+type Mode int
+
+const (
+	// Standard evaluates every op as written, so division by zero, the
+	// log of a negative number and Gamma at its poles give NaN or
+	// infinities.
+	Standard Mode = iota
+	// Protected uses the protected variant of every op, so trees never
+	// give NaN or infinities: division by zero gives 1, Log takes the log
+	// of |x| and is 0 at 0, and the results of every op are clamped to
+	// +-ProtectedLimit, with 0 in place of NaN.
+	Protected
+)
+
+func (m Mode) String() string {
+	if m == Protected {
+		return "Protected"
+	}
+	return "Standard"
+}
+
+// ProtectedLimit bounds the results of the protected operators.
+const ProtectedLimit = 1e6
+
+// bounded clamps v to +-ProtectedLimit and maps NaN to 0.
+func bounded(v float32) float32 {
+	if v != v {
+		return 0
+	} else if v > ProtectedLimit {
+		return ProtectedLimit
+	} else if v < -ProtectedLimit {
+		return -ProtectedLimit
+	}
+	return v
+}
+
+func protectedDiv(a, b float32) float32 {
+	if b == 0 {
+		return 1
+	}
+	return bounded(div(a, b))
+}
+
+func protectedLog(a float32) float32 {
+	if a == 0 {
+		return 0
+	}
+	return bounded(log2(abs(a)))
+}
+
+func protectedGamma(a float32) float32 {
+	return bounded(gamma(a))
+}
+
+func protectedSquare(a, b float32) float32 {
+	return bounded(square(a, b))
+}
+
+var (
+	operators       []*Operator
+	operatorsByName = make(map[string]*Operator)
+)
+
+// reservedNames can not be used as operator names because the parser
+// already gives them a meaning.
+var reservedNames = []string{"X", "Y", "T", "Picture", "Palette", "Stop", "Protected"}
+
+// Register adds op to the set of operators, so it can be read from .apt
+// files, compiled, and picked by GetRandomBaseNode. Names may contain
+// letters, digits and the characters +*/= and must not start with a digit.
+// Register panics if op is invalid or its name is taken. It is not safe to
+// call while trees are being generated or parsed, so register custom ops
+// during start up.
+func Register(op *Operator) {
+	if op.Name == "" || strings.Trim(op.Name, opChars) != "" || strings.IndexAny(op.Name[:1], "0123456789") >= 0 {
+		panic("ast: invalid operator name " + op.Name)
+	}
+	for _, name := range reservedNames {
+		if op.Name == name {
+			panic("ast: reserved operator name " + op.Name)
+		}
+	}
+	if _, ok := ParseColorSpace(op.Name); ok {
+		panic("ast: reserved operator name " + op.Name)
+	}
+	register(op)
+}
+
+func register(op *Operator) {
+	if op.Arity < 1 || op.Arity > MaxArity {
+		panic("ast: operator " + op.Name + " has invalid arity")
+	}
+	if op.Eval == nil {
+		panic("ast: operator " + op.Name + " has no Eval")
+	}
+	if _, ok := operatorsByName[op.Name]; ok {
+		panic("ast: operator " + op.Name + " registered twice")
+	}
+	if op.row == nil {
+		op.row = evalRow(op.Eval, op.Arity)
+	}
+	if op.Protected == nil {
+		eval := op.Eval
+		op.Protected = func(a, b, c float32) float32 { return bounded(eval(a, b, c)) }
+		if op.protectedRow == nil {
+			op.protectedRow = boundedRow(op.row)
+		}
+	}
+	if op.protectedRow == nil {
+		op.protectedRow = evalRow(op.Protected, op.Arity)
+	}
+	operators = append(operators, op)
+	operatorsByName[op.Name] = op
+}
+
+// evalRow returns a row kernel that calls eval for every value.
+func evalRow(eval func(a, b, c float32) float32, arity int) func(a, b, c []float32) {
+	switch arity {
+	case 1:
+		return func(a, _, _ []float32) {
+			for j := range a {
+				a[j] = eval(a[j], 0, 0)
+			}
+		}
+	case 2:
+		return func(a, b, _ []float32) {
+			for j := range a {
+				a[j] = eval(a[j], b[j], 0)
+			}
+		}
+	}
+	return func(a, b, c []float32) {
+		for j := range a {
+			a[j] = eval(a[j], b[j], c[j])
+		}
+	}
+}
+
+// boundedRow returns a row kernel that runs row and clamps its results
+// like bounded.
+func boundedRow(row func(a, b, c []float32)) func(a, b, c []float32) {
+	return func(a, b, c []float32) {
+		row(a, b, c)
+		for j, v := range a {
+			a[j] = bounded(v)
+		}
+	}
+}
+
+// Lookup returns the operator registered under name, or nil.
+func Lookup(name string) *Operator {
+	return operatorsByName[name]
+}
+
+// Operators returns every registered operator in registration order.
+func Operators() []*Operator {
+	return append([]*Operator(nil), operators...)
+}
+
+// OpFunc is an op node: a registered operator applied to its children.
+type OpFunc struct {
+	BaseNode
+	Op *Operator
+}
+
+// NewOp returns a node for op with empty children.
+func NewOp(op *Operator) *OpFunc {
+	return &OpFunc{BaseNode{nil, make([]Node, op.Arity)}, op}
+}
+
+func (op *OpFunc) Eval(x, y, t float32) float32 {
+	var args [MaxArity]float32
+	for i, child := range op.Children {
+		args[i] = child.Eval(x, y, t)
+	}
+	return op.Op.Eval(args[0], args[1], args[2])
+}
+
+func (op *OpFunc) String() string {
+	s := "( " + op.Op.Name
+	for _, child := range op.Children {
+		s += " " + child.String()
+	}
+	return s + " )"
+}
+
+// Blend returns Lerp(a, b, k), which is a where k is 0 and b where k is 1.
+func Blend(a, b Node, k float32) Node {
+	lerp := NewOp(lerpOp)
+	constant := NewConstant(k)
+	for i, child := range []Node{a, b, constant} {
+		lerp.Children[i] = child
+		child.SetParent(lerp)
+	}
+	return lerp
+}
+
+// The built in operators, registered in the order GetRandomBaseNode has
+// always drawn them so seeded runs stay reproducible. The math of each op is
+// written once, in the function its Eval and row kernel both call.
+var (
+	clipOp = &Operator{Name: "Clip", Arity: 2, Eval: func(a, b, _ float32) float32 {
+		return clip(a, b)
+	}, row: func(a, b, _ []float32) {
+		for j := range a {
+			a[j] = clip(a[j], b[j])
+		}
+	}}
+	negateOp = &Operator{Name: "Negate", Arity: 1, Eval: func(a, _, _ float32) float32 {
+		return negate(a)
+	}, row: func(a, _, _ []float32) {
+		for j := range a {
+			a[j] = negate(a[j])
+		}
+	}}
+	multOp = &Operator{Name: "*", Arity: 2, Eval: func(a, b, _ float32) float32 {
+		return mult(a, b)
+	}, row: func(a, b, _ []float32) {
+		for j := range a {
+			a[j] = mult(a[j], b[j])
+		}
+	}}
+	plusOp = &Operator{Name: "+", Arity: 2, Eval: func(a, b, _ float32) float32 {
+		return plus(a, b)
+	}, row: func(a, b, _ []float32) {
+		for j := range a {
+			a[j] = plus(a[j], b[j])
+		}
+	}}
+	ceilOp = &Operator{Name: "Ceil", Arity: 1, Eval: func(a, _, _ float32) float32 {
+		return ceil(a)
+	}, row: func(a, _, _ []float32) {
+		for j := range a {
+			a[j] = ceil(a[j])
+		}
+	}}
+	minusOp = &Operator{Name: "-", Arity: 2, Eval: func(a, b, _ float32) float32 {
+		return minus(a, b)
+	}, row: func(a, b, _ []float32) {
+		for j := range a {
+			a[j] = minus(a[j], b[j])
+		}
+	}}
+	divOp = &Operator{Name: "/", Arity: 2, Eval: func(a, b, _ float32) float32 {
+		return div(a, b)
+	}, Protected: func(a, b, _ float32) float32 {
+		return protectedDiv(a, b)
+	}, row: func(a, b, _ []float32) {
+		for j := range a {
+			a[j] = div(a[j], b[j])
+		}
+	}, protectedRow: func(a, b, _ []float32) {
+		for j := range a {
+			a[j] = protectedDiv(a[j], b[j])
+		}
+	}}
+	squareOp = &Operator{Name: "Square", Arity: 2, Eval: func(a, b, _ float32) float32 {
+		return square(a, b)
+	}, Protected: func(a, b, _ float32) float32 {
+		return protectedSquare(a, b)
+	}, row: func(a, b, _ []float32) {
+		for j := range a {
+			a[j] = square(a[j], b[j])
+		}
+	}, protectedRow: func(a, b, _ []float32) {
+		for j := range a {
+			a[j] = protectedSquare(a[j], b[j])
+		}
+	}}
+	lerpOp = &Operator{Name: "Lerp", Arity: 3, Eval: func(a, b, p float32) float32 {
+		return lerp(a, b, p)
+	}, row: func(a, b, p []float32) {
+		for j := range a {
+			a[j] = lerp(a[j], b[j], p[j])
+		}
+	}}
+	sinOp = &Operator{Name: "Sin", Arity: 1, Eval: func(a, _, _ float32) float32 {
+		return sin(a)
+	}, row: func(a, _, _ []float32) {
+		for j := range a {
+			a[j] = sin(a[j])
+		}
+	}}
+	cosOp = &Operator{Name: "Cos", Arity: 1, Eval: func(a, _, _ float32) float32 {
+		return cos(a)
+	}, row: func(a, _, _ []float32) {
+		for j := range a {
+			a[j] = cos(a[j])
+		}
+	}}
+	floorOp = &Operator{Name: "Floor", Arity: 1, Eval: func(a, _, _ float32) float32 {
+		return floor(a)
+	}, row: func(a, _, _ []float32) {
+		for j := range a {
+			a[j] = floor(a[j])
+		}
+	}}
+	logOp = &Operator{Name: "Log", Arity: 1, Eval: func(a, _, _ float32) float32 {
+		return log2(a)
+	}, Protected: func(a, _, _ float32) float32 {
+		return protectedLog(a)
+	}, row: func(a, _, _ []float32) {
+		for j := range a {
+			a[j] = log2(a[j])
+		}
+	}, protectedRow: func(a, _, _ []float32) {
+		for j := range a {
+			a[j] = protectedLog(a[j])
+		}
+	}}
+	wrapOp = &Operator{Name: "Wrap", Arity: 1, Eval: func(a, _, _ float32) float32 {
+		return wrap(a)
+	}, row: func(a, _, _ []float32) {
+		for j := range a {
+			a[j] = wrap(a[j])
+		}
+	}}
+	absOp = &Operator{Name: "Abs", Arity: 1, Eval: func(a, _, _ float32) float32 {
+		return abs(a)
+	}, row: func(a, _, _ []float32) {
+		for j := range a {
+			a[j] = abs(a[j])
+		}
+	}}
+	atanOp = &Operator{Name: "Atan", Arity: 1, Eval: func(a, _, _ float32) float32 {
+		return atan(a)
+	}, row: func(a, _, _ []float32) {
+		for j := range a {
+			a[j] = atan(a[j])
+		}
+	}}
+	noiseOp = &Operator{Name: "Noise", Arity: 2, Eval: func(a, b, _ float32) float32 {
+		return snoise(a, b)
+	}, row: func(a, b, _ []float32) {
+		for j := range a {
+			a[j] = snoise(a[j], b[j])
+		}
+	}}
+	fbmOp = &Operator{Name: "FBM", Arity: 3, Eval: func(a, b, c float32) float32 {
+		return fbm(a, b, c)
+	}, row: func(a, b, c []float32) {
+		for j := range a {
+			a[j] = fbm(a[j], b[j], c[j])
+		}
+	}}
+	turbulenceOp = &Operator{Name: "Turbulence", Arity: 3, Eval: func(a, b, c float32) float32 {
+		return turbulence(a, b, c)
+	}, row: func(a, b, c []float32) {
+		for j := range a {
+			a[j] = turbulence(a[j], b[j], c[j])
+		}
+	}}
+	gammaOp = &Operator{Name: "Gamma", Arity: 1, Eval: func(a, _, _ float32) float32 {
+		return gamma(a)
+	}, Protected: func(a, _, _ float32) float32 {
+		return protectedGamma(a)
+	}, row: func(a, _, _ []float32) {
+		for j := range a {
+			a[j] = gamma(a[j])
+		}
+	}, protectedRow: func(a, _, _ []float32) {
+		for j := range a {
+			a[j] = protectedGamma(a[j])
+		}
+	}}
+	hypotOp = &Operator{Name: "Hypot", Arity: 2, Eval: func(a, b, _ float32) float32 {
+		return hypot(a, b)
+	}, row: func(a, b, _ []float32) {
+		for j := range a {
+			a[j] = hypot(a[j], b[j])
+		}
+	}}
+)
+
+func clip(value, max float32) float32 {
+	max = float32(math.Abs(float64(max)))
+	if value > max {
+		return max
+	} else if value < -max {
+		return -max
+	}
+	return value
+}
+
+func negate(a float32) float32   { return -a }
+func mult(a, b float32) float32  { return a * b }
+func plus(a, b float32) float32  { return a + b }
+func minus(a, b float32) float32 { return a - b }
+func div(a, b float32) float32   { return a / b }
+func ceil(a float32) float32     { return float32(math.Ceil(float64(a))) }
+func floor(a float32) float32    { return float32(math.Floor(float64(a))) }
+func sin(a float32) float32      { return float32(math.Sin(float64(a))) }
+func cos(a float32) float32      { return float32(math.Cos(float64(a))) }
+func log2(a float32) float32     { return float32(math.Log2(float64(a))) }
+func abs(a float32) float32      { return float32(math.Abs(float64(a))) }
+func atan(a float32) float32     { return float32(math.Atan(float64(a))) }
+func gamma(a float32) float32    { return float32(math.Gamma(float64(a))) }
+func hypot(a, b float32) float32 { return float32(math.Hypot(float64(a), float64(b))) }
+
+func square(a, b float32) float32 {
+	product := a * b
+	return product * product
+}
+
+func lerp(a, b, p float32) float32 {
+	return a + p*(b-a)
+}
+
+// wrap folds a into [-1, 1), repeating every 2.
+func wrap(a float32) float32 {
+	temp := (a - 1.0) / 2.0
+	return -1.0 + 2.0*(temp-float32(math.Floor(float64(temp))))
+}
+
+func snoise(a, b float32) float32 {
+	return 80*noise.Snoise2(a, b) - 2.0
+}
+
+func fbm(a, b, c float32) float32 {
+	return 2*3.627*noise.Fbm(a, b, 5*c, 0.5, 2, 3) + .492 - 1
+}
+
+func turbulence(a, b, c float32) float32 {
+	return 2*6.96*noise.Turbulence(a, b, 5*c, 0.5, 2, 3) - 1
+}
+
+// builtins are the built in operators in registration order.
+var builtins = []*Operator{
+	clipOp, negateOp, multOp, plusOp, ceilOp, minusOp, divOp,
+	squareOp, lerpOp, sinOp, cosOp, floorOp, logOp, wrapOp,
+	absOp, atanOp, noiseOp, fbmOp, turbulenceOp, gammaOp, hypotOp,
+}
+
+func init() {
+	for _, op := range builtins {
+		register(op)
+	}
+}
@@ -0,0 +1,138 @@
+package ast
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+)
+
+// OpSet steers the look of random trees. Weights gives the relative chance
+// of each operator by name; operators it does not mention get weight 1 and
+// weight 0 leaves an operator out. OpChance is the probability that Mutate
+// replaces a node with an op rather than a leaf.
+type OpSet struct {
+	Name     string             `json:"name"`
+	Weights  map[string]float64 `json:"weights,omitempty"`
+	OpChance float64            `json:"opChance"`
+}
+
+// DefaultOpChance is the op-over-leaf chance Mutate has always used.
+const DefaultOpChance = 22.0 / 24
+
+// UnmarshalJSON reads s like the default decoder but leaves OpChance at
+// DefaultOpChance when the JSON does not give one.
+func (s *OpSet) UnmarshalJSON(data []byte) error {
+	type plain OpSet
+	p := plain{OpChance: DefaultOpChance}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	*s = OpSet(p)
+	return nil
+}
+
+// Presets are the built in op sets. The first one is the default.
+var Presets = []OpSet{
+	{Name: "uniform", OpChance: DefaultOpChance},
+	{Name: "noisy", OpChance: DefaultOpChance, Weights: map[string]float64{
+		"Noise": 4, "FBM": 4, "Turbulence": 4, "Sin": 2, "Cos": 2,
+	}},
+	{Name: "geometric", OpChance: DefaultOpChance, Weights: map[string]float64{
+		"Floor": 3, "Ceil": 3, "Abs": 3, "Clip": 3, "Wrap": 3, "Hypot": 3,
+		"Noise": 0, "FBM": 0, "Turbulence": 0,
+	}},
+	{Name: "smooth", OpChance: 0.8, Weights: map[string]float64{
+		"Floor": 0, "Ceil": 0, "Wrap": 0, "Gamma": 0,
+		"Sin": 2, "Cos": 2, "Lerp": 2, "FBM": 2,
+	}},
+}
+
+var activeOps = Presets[0]
+
+// Weight returns the selection weight of op in s.
+func (s OpSet) Weight(op *Operator) float64 {
+	if w, ok := s.Weights[op.Name]; ok {
+		return w
+	}
+	return 1
+}
+
+// Validate reports whether s names only registered operators, has no
+// negative weights, leaves at least one operator to pick and has an
+// OpChance between 0 and 1.
+func (s OpSet) Validate() error {
+	for name, w := range s.Weights {
+		if Lookup(name) == nil {
+			return fmt.Errorf("op set %s: unknown op %q", s.Name, name)
+		}
+		if w < 0 {
+			return fmt.Errorf("op set %s: negative weight for %s", s.Name, name)
+		}
+	}
+	total := 0.0
+	for _, op := range operators {
+		total += s.Weight(op)
+	}
+	if total <= 0 {
+		return fmt.Errorf("op set %s: every op has weight 0", s.Name)
+	}
+	if s.OpChance < 0 || s.OpChance > 1 {
+		return fmt.Errorf("op set %s: op chance must be between 0 and 1", s.Name)
+	}
+	return nil
+}
+
+// SetOpSet makes s the op set used by GetRandomBaseNode and Mutate.
+func SetOpSet(s OpSet) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	activeOps = s
+	return nil
+}
+
+// CurrentOpSet returns the op set in use.
+func CurrentOpSet() OpSet {
+	return activeOps
+}
+
+// pickOperator draws an operator according to the active weights. An op
+// set without weights draws uniformly, exactly as before weights existed.
+func pickOperator(rng *rand.Rand) *Operator {
+	if len(activeOps.Weights) == 0 {
+		return operators[rng.Intn(len(operators))]
+	}
+	return pickOperatorWhere(rng, func(*Operator) bool { return true })
+}
+
+// pickOperatorWithArity draws an operator taking arity children according
+// to the active weights, or returns nil if there is none.
+func pickOperatorWithArity(rng *rand.Rand, arity int) *Operator {
+	return pickOperatorWhere(rng, func(op *Operator) bool { return op.Arity == arity })
+}
+
+func pickOperatorWhere(rng *rand.Rand, keep func(*Operator) bool) *Operator {
+	total := 0.0
+	for _, op := range operators {
+		if keep(op) {
+			total += activeOps.Weight(op)
+		}
+	}
+	if total <= 0 {
+		return nil
+	}
+	r := rng.Float64() * total
+	var picked *Operator
+	for _, op := range operators {
+		w := activeOps.Weight(op)
+		if !keep(op) || w <= 0 {
+			continue
+		}
+		picked = op
+		if r < w {
+			break
+		}
+		r -= w
+	}
+	return picked
+}
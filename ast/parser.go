@@ -1,6 +1,7 @@
 package ast
 
 import (
+	"fmt"
 	"strconv"
 	"strings"
 	"unicode/utf8"
@@ -13,11 +14,14 @@ const (
 	closeParen
 	op
 	constant
+	eofToken
 )
 
 type token struct {
-	typ   tokenType
-	value string
+	typ    tokenType
+	value  string
+	line   int
+	column int
 }
 
 type lexer struct {
@@ -25,116 +29,244 @@ type lexer struct {
 	start  int
 	pos    int
 	width  int
-	tokens chan token
+	line   int
+	column int
+	state  stateFunc
+	tokens []token
 }
 
 const eof rune = -1
 
 type stateFunc func(*lexer) stateFunc
 
-func BeginLexing(s string) Node {
-	l := &lexer{input: s, tokens: make(chan token, 100)}
-	go l.run()
-	return parse(l.tokens, nil)
+// ParseError describes why an .apt file could not be parsed. Line and Column
+// are 1-based and point at the start of the offending token.
+type ParseError struct {
+	Line   int
+	Column int
+	Token  string
+	Msg    string
 }
 
-func (l *lexer) run() {
-	for state := determineToken; state != nil; {
-		state = state(l)
+func (e *ParseError) Error() string {
+	if e.Token == "" {
+		return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Msg)
 	}
-	close(l.tokens)
+	return fmt.Sprintf("line %d, column %d: %s %q", e.Line, e.Column, e.Msg, e.Token)
+}
+
+func newLexer(s string) *lexer {
+	return &lexer{input: s, line: 1, column: 1, state: determineToken}
+}
+
+// BeginLexing parses a saved picture. The result is either an *OpPicture
+// with exactly three channel trees or an *OpPalette with at least two
+// gradient stops and one tree.
+func BeginLexing(s string) (Node, error) {
+	l := newLexer(s)
+	for {
+		t, ok := l.peekToken(0)
+		if !ok {
+			return nil, &ParseError{t.line, t.column, "", "unexpected end of input"}
+		}
+		if t.typ != openParen && t.typ != closeParen {
+			if t.typ != op || (t.value != "Picture" && t.value != "Palette") {
+				return nil, &ParseError{t.line, t.column, t.value, "expected Picture or Palette at root, got"}
+			}
+			break
+		}
+		l.nextToken()
+	}
+
+	root, err := parse(l, nil)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, ok := l.nextToken()
+		if !ok {
+			break
+		}
+		if t.typ != openParen && t.typ != closeParen {
+			return nil, &ParseError{t.line, t.column, t.value, "too many children for " + rootName(root) + ", found extra"}
+		}
+	}
+	return root, nil
+}
+
+func rootName(root Node) string {
+	if _, ok := root.(*OpPalette); ok {
+		return "Palette"
+	}
+	return "Picture"
+}
+
+// nextToken runs the lexer state machine until a token is available. The
+// second result is false once the input is exhausted.
+func (l *lexer) nextToken() (token, bool) {
+	t, ok := l.peekToken(0)
+	if ok {
+		l.tokens = l.tokens[1:]
+	}
+	return t, ok
+}
+
+// peekToken returns the token n places ahead without consuming anything.
+func (l *lexer) peekToken(n int) (token, bool) {
+	for len(l.tokens) <= n {
+		if l.state == nil {
+			return token{typ: eofToken, line: l.line, column: l.column}, false
+		}
+		l.state = l.state(l)
+	}
+	return l.tokens[n], true
+}
+
+// parseStops reads the ( Stop pos r g b ) entries at the start of a
+// Palette, stopping at the first token that does not begin a stop.
+func parseStops(l *lexer) ([]GradientStop, error) {
+	stops := make([]GradientStop, 0)
+	for {
+		i := 0
+		t, ok := l.peekToken(i)
+		for ok && (t.typ == openParen || t.typ == closeParen) {
+			i++
+			t, ok = l.peekToken(i)
+		}
+		if !ok || t.typ != op || t.value != "Stop" {
+			return stops, nil
+		}
+		for ; i >= 0; i-- {
+			l.nextToken()
+		}
+
+		var values [4]float64
+		for j := range values {
+			v, err := nextNumber(l)
+			if err != nil {
+				return nil, err
+			}
+			values[j] = v
+		}
+		if values[0] < 0 || values[0] > 1 {
+			return nil, &ParseError{t.line, t.column, t.value, "position must be between 0 and 1 in"}
+		}
+		for _, c := range values[1:] {
+			if c < 0 || c > 255 {
+				return nil, &ParseError{t.line, t.column, t.value, "color must be between 0 and 255 in"}
+			}
+		}
+		stops = append(stops, GradientStop{float32(values[0]), byte(values[1]), byte(values[2]), byte(values[3])})
+	}
+}
+
+// parseMode reads the optional Protected that follows Picture, after its
+// color space, or Palette.
+func parseMode(l *lexer) Mode {
+	if t, ok := l.peekToken(0); ok && t.typ == op && t.value == Protected.String() {
+		l.nextToken()
+		return Protected
+	}
+	return Standard
+}
+
+func nextNumber(l *lexer) (float64, error) {
+	t, ok := l.nextToken()
+	if !ok {
+		return 0, &ParseError{t.line, t.column, "", "unexpected end of input"}
+	}
+	if t.typ != constant {
+		return 0, &ParseError{t.line, t.column, t.value, "expected number, got"}
+	}
+	v, err := strconv.ParseFloat(t.value, 32)
+	if err != nil {
+		return 0, &ParseError{t.line, t.column, t.value, "invalid number"}
+	}
+	return v, nil
 }
 
 func stringToNode(s string) Node {
 	switch s {
-	case "Clip":
-		return NewOpClip()
-	case "Negate":
-		return NewOpNegate()
-	case "*":
-		return NewOpMult()
-	case "+":
-		return NewOpPlus()
-	case "Ceil":
-		return NewOpCeil()
-	case "-":
-		return NewOpMinus()
-	case "/":
-		return NewOpDiv()
-	case "Square":
-		return NewOpSquare()
-	case "Lerp":
-		return NewOpLerp()
-	case "Sin":
-		return NewOpSin()
-	case "Cos":
-		return NewOpCos()
-	case "Floor":
-		return NewOpFloor()
-	case "Log":
-		return NewOpLog()
-	case "Wrap":
-		return NewOpWrap()
-	case "Abs":
-		return NewOpAbs()
-	case "Atan":
-		return NewOpAtan()
-	case "Noise":
-		return NewOpNoise()
-	case "FBM":
-		return NewOpFBM()
-	case "Turbulence":
-		return NewOpTurbulence()
-	case "Gamma":
-		return NewOpGamma()
 	case "X":
 		return NewOpX()
 	case "Y":
 		return NewOpY()
+	case "T":
+		return NewOpT()
 	case "Picture":
 		return NewOpPicture()
-	case "Hypot":
-		return NewOpHypot()
-	default:
-		panic("error in parser" + s)
+	case "Palette":
+		return NewOpPalette()
 	}
+	if op := Lookup(s); op != nil {
+		return NewOp(op)
+	}
+	return nil
 }
 
-func parse(tokens chan token, parent Node) Node {
+func parse(l *lexer, parent Node) (Node, error) {
 
 	for {
-		token, ok := <-tokens
+		token, ok := l.nextToken()
 		if !ok {
-			panic("no more tokens")
-
+			return nil, &ParseError{token.line, token.column, "", "unexpected end of input"}
 		}
 
 		switch token.typ {
 		case op:
 			n := stringToNode(token.value)
+			if n == nil {
+				return nil, &ParseError{token.line, token.column, token.value, "unknown op"}
+			}
+			if picture, ok := n.(*OpPicture); ok {
+				if parent != nil {
+					return nil, &ParseError{token.line, token.column, token.value, "unexpected nested"}
+				}
+				if next, ok := l.peekToken(0); ok && next.typ == op {
+					if space, ok := ParseColorSpace(next.value); ok {
+						picture.Space = space
+						l.nextToken()
+					}
+				}
+				picture.Mode = parseMode(l)
+			}
+			if palette, ok := n.(*OpPalette); ok {
+				if parent != nil {
+					return nil, &ParseError{token.line, token.column, token.value, "unexpected nested"}
+				}
+				palette.Mode = parseMode(l)
+				stops, err := parseStops(l)
+				if err != nil {
+					return nil, err
+				}
+				if len(stops) < 2 {
+					return nil, &ParseError{token.line, token.column, token.value, "need at least two stops in"}
+				}
+				palette.Stops = stops
+			}
 			n.SetParent(parent)
 
 			for i := range n.GetChildren() {
-				n.GetChildren()[i] = parse(tokens, n)
+				child, err := parse(l, n)
+				if err != nil {
+					return nil, err
+				}
+				n.GetChildren()[i] = child
 			}
-			return n
+			return n, nil
 
 		case constant:
-			n := NewOpConstant()
-			n.SetParent(parent)
 			v, err := strconv.ParseFloat(token.value, 32)
 			if err != nil {
-				panic(err)
+				return nil, &ParseError{token.line, token.column, token.value, "invalid number"}
 			}
-			n.value = float32(v)
-			return n
+			n := &OpConstant{BaseNode{parent, make([]Node, 0)}, float32(v)}
+			return n, nil
 
 		case closeParen, openParen:
 			continue
 		}
 	}
-
-	return nil
 }
 
 func determineToken(l *lexer) stateFunc {
@@ -156,8 +288,11 @@ func determineToken(l *lexer) stateFunc {
 	}
 }
 
+// opChars are the characters an op name can be made of.
+const opChars = "+=/*qwertyuiopasdfghjklzxcvbnmQWERTYUIOPASDFGHJKLZXCVBNM1234567890"
+
 func lexOp(l *lexer) stateFunc {
-	l.acceptRun("+=/*qwertyuiopasdfghjklzxcvbnmQWERTYUIOPASDFGHJKLZXCVBNM1234567890")
+	l.acceptRun(opChars)
 	l.emit(op)
 	return determineToken
 }
@@ -203,8 +338,8 @@ func isStartNumber(r rune) bool {
 }
 
 func (l *lexer) emit(t tokenType) {
-	l.tokens <- token{t, l.input[l.start:l.pos]}
-	l.start = l.pos
+	l.tokens = append(l.tokens, token{t, l.input[l.start:l.pos], l.line, l.column})
+	l.ignore()
 }
 
 func (l *lexer) next() (r rune) {
@@ -222,7 +357,16 @@ func (l *lexer) backup() {
 	l.pos -= l.width
 }
 
+// ignore skips the pending input, keeping line and column in step with it.
 func (l *lexer) ignore() {
+	for _, r := range l.input[l.start:l.pos] {
+		if r == '\n' {
+			l.line++
+			l.column = 1
+		} else {
+			l.column++
+		}
+	}
 	l.start = l.pos
 }
 
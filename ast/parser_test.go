@@ -0,0 +1,62 @@
+package ast
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseErrors(t *testing.T) {
+	for _, c := range []struct {
+		src          string
+		line, column int
+		token, msg   string
+	}{
+		{"", 1, 1, "", "unexpected end of input"},
+		{"  \n ( ", 2, 4, "", "unexpected end of input"},
+		{"( Foo X Y Z )", 1, 3, "Foo", "expected Picture or Palette at root, got"},
+		{"( X )", 1, 3, "X", "expected Picture or Palette at root, got"},
+		{"( 1.000000000 )", 1, 3, "1.000000000", "expected Picture or Palette at root, got"},
+		{"( Picture\nX\n( Bogus X )\nY )", 3, 3, "Bogus", "unknown op"},
+		{"( Picture X ( + Y ) ", 1, 21, "", "unexpected end of input"},
+		{"( Picture X Y", 1, 14, "", "unexpected end of input"},
+		{"( Picture X Y T X )", 1, 17, "X", "too many children for Picture, found extra"},
+		{"( Picture X\n( Picture X Y T )\nT )", 2, 3, "Picture", "unexpected nested"},
+		{"( Picture X ( Palette ( Stop 0 0 0 0 ) ( Stop 1 0 0 0 ) X ) T )", 1, 15, "Palette", "unexpected nested"},
+		{"( Palette ( Stop 0 0 0 0 ) X )", 1, 3, "Palette", "need at least two stops in"},
+		{"( Palette ( Stop 2 0 0 0 ) ( Stop 1 0 0 0 ) X )", 1, 13, "Stop", "position must be between 0 and 1 in"},
+		{"( Palette ( Stop 0 0 300 0 ) ( Stop 1 0 0 0 ) X )", 1, 13, "Stop", "color must be between 0 and 255 in"},
+		{"( Palette ( Stop 0 0 0 ) ( Stop 1 0 0 0 ) X )", 1, 24, ")", "expected number, got"},
+		{"( Palette ( Stop 0 0 0", 1, 23, "", "unexpected end of input"},
+		{"( Palette ( Stop 0 0 0 0 ) ( Stop 1 0 0 0 ) X Y )", 1, 47, "Y", "too many children for Palette, found extra"},
+	} {
+		_, err := BeginLexing(c.src)
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("%q: got error %v, want a ParseError", c.src, err)
+			continue
+		}
+		want := ParseError{c.line, c.column, c.token, c.msg}
+		if *perr != want {
+			t.Errorf("%q: got %#v, want %#v", c.src, *perr, want)
+		}
+	}
+}
+
+func TestParseRoundTrip(t *testing.T) {
+	for _, src := range []string{
+		"( Picture\nX\nY\nT )",
+		"( Picture HSV\n( + X -0.500000000 )\n( Sin Y )\n( Lerp X Y T ) )",
+		"( Picture Lab Protected\n( / X Y )\n( Log X )\n( Gamma Y ) )",
+		"( Palette\n( Stop 0.000000000 0 0 0 )\n( Stop 1.000000000 255 255 255 )\n( Noise X Y ) )",
+		"( Palette Protected\n( Stop 0.250000000 1 2 3 )\n( Stop 0.750000000 4 5 6 )\n( Square X Y ) )",
+	} {
+		root, err := BeginLexing(src)
+		if err != nil {
+			t.Errorf("%q: %v", src, err)
+			continue
+		}
+		if got := root.String(); got != src {
+			t.Errorf("%q parses as %q", src, got)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package ast
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// singularity is an op applied to arguments where it has no finite value,
+// and what it gives there in each mode. Arguments past the op's arity are
+// ignored.
+type singularity struct {
+	op                  *Operator
+	a, b, c             float32
+	standard, protected float32
+}
+
+var singularities = []singularity{
+	{clipOp, posInf, 0.25, 0, 0.25, 0.25},
+	{clipOp, nan, 0.25, 0, nan, 0},
+	{clipOp, posInf, posInf, 0, posInf, ProtectedLimit},
+	{negateOp, posInf, 0, 0, negInf, -ProtectedLimit},
+	{negateOp, nan, 0, 0, nan, 0},
+	{multOp, 1e30, 1e30, 0, posInf, ProtectedLimit},
+	{multOp, posInf, 0, 0, nan, 0},
+	{plusOp, 3e38, 3e38, 0, posInf, ProtectedLimit},
+	{plusOp, posInf, negInf, 0, nan, 0},
+	{ceilOp, negInf, 0, 0, negInf, -ProtectedLimit},
+	{ceilOp, nan, 0, 0, nan, 0},
+	{minusOp, -3e38, 3e38, 0, negInf, -ProtectedLimit},
+	{minusOp, posInf, posInf, 0, nan, 0},
+	{divOp, 1, 0, 0, posInf, 1},
+	{divOp, 1, negZero, 0, negInf, 1},
+	{divOp, -1, 0, 0, negInf, 1},
+	{divOp, 0, 0, 0, nan, 1},
+	{divOp, 0, negZero, 0, nan, 1},
+	{divOp, posInf, 0, 0, posInf, 1},
+	{divOp, 1e30, 1e-30, 0, posInf, ProtectedLimit},
+	{squareOp, 1e20, 1, 0, posInf, ProtectedLimit},
+	{squareOp, -1e20, 1, 0, posInf, ProtectedLimit},
+	{squareOp, 1e10, 1e10, 0, posInf, ProtectedLimit},
+	{squareOp, 1e3, 1e3, 0, 1e12, ProtectedLimit},
+	{squareOp, posInf, 0, 0, nan, 0},
+	{lerpOp, posInf, 0.25, 0.5, nan, 0},
+	{lerpOp, 0.5, 0.25, negInf, posInf, ProtectedLimit},
+	{lerpOp, 0.5, 0.25, nan, nan, 0},
+	{sinOp, posInf, 0, 0, nan, 0},
+	{sinOp, nan, 0, 0, nan, 0},
+	{cosOp, negInf, 0, 0, nan, 0},
+	{floorOp, 1e30, 0, 0, 1e30, ProtectedLimit},
+	{floorOp, posInf, 0, 0, posInf, ProtectedLimit},
+	{logOp, 0, 0, 0, negInf, 0},
+	{logOp, negZero, 0, 0, negInf, 0},
+	{logOp, -1, 0, 0, nan, 0},
+	{logOp, -4, 0, 0, nan, 2},
+	{logOp, negInf, 0, 0, nan, ProtectedLimit},
+	{logOp, nan, 0, 0, nan, 0},
+	{wrapOp, posInf, 0, 0, nan, 0},
+	{wrapOp, nan, 0, 0, nan, 0},
+	{absOp, negInf, 0, 0, posInf, ProtectedLimit},
+	{atanOp, posInf, 0, 0, math.Pi / 2, math.Pi / 2},
+	{atanOp, nan, 0, 0, nan, 0},
+	// Noise ops truncate their arguments to ints, which is not defined
+	// for infinities, so TestProtectedIsFinite covers those.
+	{noiseOp, nan, 0.25, 0, nan, 0},
+	{noiseOp, 0.5, nan, 0, nan, 0},
+	{fbmOp, nan, 0.25, 0.5, nan, 0},
+	{fbmOp, 0.5, 0.25, nan, nan, 0},
+	{turbulenceOp, 0.5, nan, 0.5, nan, 0},
+	{gammaOp, 0, 0, 0, posInf, ProtectedLimit},
+	{gammaOp, negZero, 0, 0, negInf, -ProtectedLimit},
+	{gammaOp, -1, 0, 0, nan, 0},
+	{gammaOp, -2, 0, 0, nan, 0},
+	{gammaOp, -3, 0, 0, nan, 0},
+	{gammaOp, 40, 0, 0, posInf, ProtectedLimit},
+	{gammaOp, negInf, 0, 0, nan, 0},
+	{hypotOp, posInf, nan, 0, posInf, ProtectedLimit},
+	{hypotOp, nan, 0.25, 0, nan, 0},
+	{hypotOp, 3e38, 3e38, 0, posInf, ProtectedLimit},
+}
+
+func TestSingularities(t *testing.T) {
+	tested := make(map[*Operator]bool)
+	for _, s := range singularities {
+		tested[s.op] = true
+		args := []float32{s.a, s.b, s.c}[:s.op.Arity]
+		t.Run(fmt.Sprintf("%s%v", s.op.Name, args), func(t *testing.T) {
+			if got := s.op.Eval(s.a, s.b, s.c); !sameValue(got, s.standard) {
+				t.Errorf("Eval gives %v, want %v", got, s.standard)
+			}
+			if got := s.op.Protected(s.a, s.b, s.c); !sameValue(got, s.protected) {
+				t.Errorf("Protected gives %v, want %v", got, s.protected)
+			}
+
+			// X stands in for the first argument, so the compiled
+			// programs take it from the row as well as from a constant.
+			children := []Node{NewOpX(), NewConstant(s.b), NewConstant(s.c)}[:s.op.Arity]
+			for _, node := range []Node{
+				withChildren(s.op, children...),
+				withChildren(s.op, append([]Node{NewConstant(s.a)}, children[1:]...)...),
+			} {
+				if got := node.Eval(s.a, 0, 0); !sameValue(got, s.standard) {
+					t.Errorf("%s: tree gives %v, want %v", node, got, s.standard)
+				}
+				for _, mode := range []Mode{Standard, Protected} {
+					want := s.standard
+					if mode == Protected {
+						want = s.protected
+					}
+					program := Compile(node, mode)
+					if got := program.Eval(program.NewStack(), s.a, 0, 0); !sameValue(got, want) {
+						t.Errorf("%s in %s mode: Eval gives %v, want %v", node, mode, got, want)
+					}
+					row := make([]float32, 3)
+					program.EvalRow(program.NewRowStack(len(row)), []float32{s.a, s.a, s.a}, 0, 0, row)
+					for _, got := range row {
+						if !sameValue(got, want) {
+							t.Errorf("%s in %s mode: EvalRow gives %v, want %v", node, mode, got, want)
+						}
+					}
+				}
+			}
+		})
+	}
+	for _, op := range builtins {
+		if !tested[op] {
+			t.Errorf("no singularities of %s are tested", op.Name)
+		}
+	}
+}
+
+func TestProtectedIsFinite(t *testing.T) {
+	for _, op := range Operators() {
+		node := withChildren(op, []Node{NewOpX(), NewOpY(), NewOpT()}[:op.Arity]...)
+		program := Compile(node, Protected)
+		rowStack := program.NewRowStack(len(testValues))
+		row := make([]float32, len(testValues))
+		for _, y := range argValues(op, 1) {
+			for _, ty := range argValues(op, 2) {
+				program.EvalRow(rowStack, testValues, y, ty, row)
+				for i, x := range testValues {
+					if !isFinite(row[i]) {
+						t.Errorf("%s in Protected mode gives %v at (%v, %v, %v)", node, row[i], x, y, ty)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestBounded(t *testing.T) {
+	for _, c := range []struct{ v, want float32 }{
+		{0, 0},
+		{negZero, negZero},
+		{-3.5, -3.5},
+		{ProtectedLimit, ProtectedLimit},
+		{2e6, ProtectedLimit},
+		{-2e6, -ProtectedLimit},
+		{posInf, ProtectedLimit},
+		{negInf, -ProtectedLimit},
+		{nan, 0},
+	} {
+		if got := bounded(c.v); !sameValue(got, c.want) {
+			t.Errorf("bounded(%v) = %v, want %v", c.v, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package ast
+
+import (
+	"math"
+	"strconv"
+)
+
+// Simplify rewrites the tree under node without its redundant parts and
+// returns the new root. The simplified tree evaluates to exactly the same
+// values as the original at every point, in Standard and Protected mode,
+// where points have coordinates and time between -1 and 1:
+//
+//   - ops whose arguments are all constants are folded into a constant,
+//     unless the result is not finite, would not survive being saved, or
+//     differs between the modes
+//   - x - 0 and x * 1 become x if x is within +-ProtectedLimit, x - x
+//     becomes 0 if x is always finite, and x * 0 becomes 0 if x is always
+//     finite and not negative
+//   - Negate(Negate x) becomes x if x is within +-ProtectedLimit, and
+//     Abs(Negate x) becomes Abs x
+//   - Floor and Ceil of Floor or Ceil and Abs of Abs are dropped
+//
+// The tree is changed in place, so copy it first to keep the original.
+func Simplify(node Node) Node {
+	parent := node.GetParent()
+	children := node.GetChildren()
+	for i, child := range children {
+		children[i] = Simplify(child)
+		children[i].SetParent(node)
+	}
+	simplified := simplify(node)
+	simplified.SetParent(parent)
+	return simplified
+}
+
+// simplify applies the rules that match node, whose children are already
+// simplified.
+func simplify(node Node) Node {
+	op, ok := node.(*OpFunc)
+	if !ok {
+		return node
+	}
+	if folded := fold(op); folded != nil {
+		return folded
+	}
+	args := op.Children
+	switch op.Op {
+	case minusOp:
+		if isConstant(args[1], 0) && inBounds(args[0]) {
+			return args[0]
+		}
+		if finite, _ := analyze(args[0]); finite && sameTree(args[0], args[1]) {
+			return NewConstant(0)
+		}
+	case multOp:
+		for i, arg := range args {
+			other := args[1-i]
+			if isConstant(arg, 1) && inBounds(other) {
+				return other
+			}
+			if finite, nonNegative := analyze(other); finite && nonNegative && isConstant(arg, 0) {
+				return NewConstant(0)
+			}
+		}
+	case negateOp:
+		if inner, ok := args[0].(*OpFunc); ok && inner.Op == negateOp && inBounds(inner.Children[0]) {
+			return inner.Children[0]
+		}
+	case floorOp, ceilOp:
+		if inner, ok := args[0].(*OpFunc); ok && (inner.Op == floorOp || inner.Op == ceilOp) {
+			return inner
+		}
+	case absOp:
+		if inner, ok := args[0].(*OpFunc); ok {
+			if inner.Op == absOp {
+				return inner
+			}
+			if inner.Op == negateOp {
+				inner.Children[0].SetParent(op)
+				args[0] = inner.Children[0]
+				return simplify(op)
+			}
+		}
+	}
+	return op
+}
+
+// fold returns the constant op evaluates to if all its arguments are
+// constants, or nil if it can not be folded.
+func fold(op *OpFunc) Node {
+	var args [MaxArity]float32
+	for i, child := range op.Children {
+		constant, ok := child.(*OpConstant)
+		if !ok {
+			return nil
+		}
+		args[i] = constant.value
+	}
+	v := op.Op.Eval(args[0], args[1], args[2])
+	if !isFinite(v) {
+		return nil
+	}
+	if math.Float32bits(op.Op.Protected(args[0], args[1], args[2])) != math.Float32bits(v) {
+		return nil
+	}
+	// Constants are saved with a fixed number of decimals, which loses
+	// the precision of some values.
+	constant := NewConstant(v)
+	if parsed, err := strconv.ParseFloat(constant.String(), 32); err != nil || math.Float32bits(float32(parsed)) != math.Float32bits(v) {
+		return nil
+	}
+	return constant
+}
+
+// isConstant reports whether node is the constant v, with the same sign if
+// v is zero.
+func isConstant(node Node, v float32) bool {
+	constant, ok := node.(*OpConstant)
+	return ok && math.Float32bits(constant.value) == math.Float32bits(v)
+}
+
+// inBounds reports whether node is always within +-ProtectedLimit, so an
+// op over it can be dropped without losing the clamp Protected mode gives
+// its result. Ops are clamped themselves and X, Y and T stay within -1 and
+// 1, so only constants can be out of bounds.
+func inBounds(node Node) bool {
+	if constant, ok := node.(*OpConstant); ok {
+		return constant.value >= -ProtectedLimit && constant.value <= ProtectedLimit
+	}
+	return true
+}
+
+// sameTree reports whether a and b are the same ops over the same leaves,
+// with constants that are equal to the bit.
+func sameTree(a, b Node) bool {
+	switch a := a.(type) {
+	case *OpX:
+		_, ok := b.(*OpX)
+		return ok
+	case *OpY:
+		_, ok := b.(*OpY)
+		return ok
+	case *OpT:
+		_, ok := b.(*OpT)
+		return ok
+	case *OpConstant:
+		b, ok := b.(*OpConstant)
+		return ok && math.Float32bits(a.value) == math.Float32bits(b.value)
+	case *OpFunc:
+		b, ok := b.(*OpFunc)
+		if !ok || a.Op != b.Op {
+			return false
+		}
+		for i, child := range a.Children {
+			if !sameTree(child, b.Children[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func isFinite(v float32) bool {
+	return !math.IsNaN(float64(v)) && !math.IsInf(float64(v), 0)
+}
+
+// analyze reports whether node is finite at every point in both modes,
+// and whether it is then never negative, including -0. It only knows
+// about ops that can not overflow.
+func analyze(node Node) (finite, nonNegative bool) {
+	switch n := node.(type) {
+	case *OpX, *OpY, *OpT:
+		return true, false
+	case *OpConstant:
+		return isFinite(n.value), !math.Signbit(float64(n.value))
+	case *OpFunc:
+		finite, nonNegative := analyze(n.Children[0])
+		switch n.Op {
+		case sinOp, cosOp, atanOp, wrapOp, negateOp, clipOp:
+			return finite, false
+		case absOp:
+			return finite, true
+		case floorOp, ceilOp:
+			return finite, nonNegative
+		}
+	}
+	return false, false
+}
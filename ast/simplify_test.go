@@ -0,0 +1,191 @@
+package ast
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// parseChannel parses src as the first channel of a picture.
+func parseChannel(t *testing.T, src string) Node {
+	t.Helper()
+	root, err := BeginLexing("( Picture " + src + " X Y )")
+	if err != nil {
+		t.Fatalf("%q: %v", src, err)
+	}
+	return root.GetChildren()[0]
+}
+
+// checkParents fails if a node under node does not point back at its
+// parent.
+func checkParents(t *testing.T, node Node) {
+	t.Helper()
+	for _, child := range node.GetChildren() {
+		if child.GetParent() != node {
+			t.Fatalf("%s is not the parent of %s", node, child)
+		}
+		checkParents(t, child)
+	}
+}
+
+func TestSimplifyRules(t *testing.T) {
+	for _, c := range []struct{ src, want string }{
+		// Constant arguments are folded, unless the result is not
+		// finite, differs in Protected mode or is lost when saved.
+		{"( + 1.000000000 2.000000000 )", "3.000000000"},
+		{"( Sin ( * 0.000000000 3.000000000 ) )", "0.000000000"},
+		{"( Log 2.000000000 )", "1.000000000"},
+		{"( / 1.000000000 0.000000000 )", "( / 1.000000000 0.000000000 )"},
+		{"( Log -4.000000000 )", "( Log -4.000000000 )"},
+		{"( / 10000000.000000000 1.000000000 )", "( / 10000000.000000000 1.000000000 )"},
+		{"( * 0.000100000 0.000001000 )", "( * 0.000100000 0.000001000 )"},
+
+		// x - 0
+		{"( - X 0.000000000 )", "X"},
+		{"( - ( Sin Y ) ( + 0.500000000 -0.500000000 ) )", "( Sin Y )"},
+		{"( - 0.000000000 X )", "( - 0.000000000 X )"},
+		{"( - 10000000.000000000 0.000000000 )", "( - 10000000.000000000 0.000000000 )"},
+
+		// x * 1
+		{"( * 1.000000000 Y )", "Y"},
+		{"( * Y 1.000000000 )", "Y"},
+		{"( * Y -1.000000000 )", "( * Y -1.000000000 )"},
+		{"( * 1.000000000 -20000000.000000000 )", "( * 1.000000000 -20000000.000000000 )"},
+
+		// x - x, only for x that is always finite
+		{"( - ( Sin X ) ( Sin X ) )", "0.000000000"},
+		{"( - T T )", "0.000000000"},
+		{"( - ( Log X ) ( Log X ) )", "( - ( Log X ) ( Log X ) )"},
+		{"( - X Y )", "( - X Y )"},
+
+		// x * 0, only for x that is always finite and never negative
+		{"( * ( Abs X ) 0.000000000 )", "0.000000000"},
+		{"( * 0.000000000 ( Floor ( Abs Y ) ) )", "0.000000000"},
+		{"( * X 0.000000000 )", "( * X 0.000000000 )"},
+		{"( * ( Abs ( / 1.000000000 X ) ) 0.000000000 )", "( * ( Abs ( / 1.000000000 X ) ) 0.000000000 )"},
+
+		// Negate(Negate x)
+		{"( Negate ( Negate X ) )", "X"},
+		{"( Negate ( Negate ( Negate X ) ) )", "( Negate X )"},
+		{"( Negate ( Negate 10000000.000000000 ) )", "( Negate ( Negate 10000000.000000000 ) )"},
+
+		// Abs(Negate x)
+		{"( Abs ( Negate X ) )", "( Abs X )"},
+		{"( Abs ( Negate ( Negate ( Abs X ) ) ) )", "( Abs X )"},
+
+		// Floor and Ceil of Floor or Ceil
+		{"( Floor ( Ceil X ) )", "( Ceil X )"},
+		{"( Ceil ( Floor X ) )", "( Floor X )"},
+		{"( Floor ( Floor ( Floor X ) ) )", "( Floor X )"},
+		{"( Floor ( Abs X ) )", "( Floor ( Abs X ) )"},
+
+		// Abs(Abs x)
+		{"( Abs ( Abs X ) )", "( Abs X )"},
+		{"( Abs ( Abs ( Abs Y ) ) )", "( Abs Y )"},
+	} {
+		root := parseChannel(t, c.src).GetParent()
+		channel := root.GetChildren()[0]
+		simplified := Simplify(channel)
+		if got := simplified.String(); got != c.want {
+			t.Errorf("Simplify(%s) = %s, want %s", c.src, got, c.want)
+		}
+		if simplified.GetParent() != root {
+			t.Errorf("Simplify(%s) lost its parent", c.src)
+		}
+		checkParents(t, simplified)
+	}
+}
+
+func TestSimplifyComparesConstantsExactly(t *testing.T) {
+	// Both constants are saved as 0.000000000, and Sin of them is too
+	// small to fold.
+	tiny := func(v float32) Node { return withChildren(sinOp, NewConstant(v)) }
+	for _, c := range []struct {
+		a, b   float32
+		folded bool
+	}{
+		{1e-10, 2e-10, false},
+		{1e-10, 1e-10, true},
+	} {
+		node := withChildren(minusOp, tiny(c.a), tiny(c.b))
+		simplified := Simplify(node)
+		if _, folded := simplified.(*OpConstant); folded != c.folded {
+			t.Errorf("Sin(%v) - Sin(%v) simplified to %s", c.a, c.b, simplified)
+		}
+	}
+}
+
+// simplifyPicture simplifies the channels of the picture root in place.
+func simplifyPicture(root Node) {
+	children := root.GetChildren()
+	for i, child := range children {
+		children[i] = Simplify(child)
+	}
+}
+
+func TestSimplifiedReparses(t *testing.T) {
+	root, err := BeginLexing("( Picture\n( + 0.500000000 0.250000000 )\n( * 3.000000000 ( - X 0.000000000 ) )\n( Sin ( / 1.000000000 3.000000000 ) ) )")
+	if err != nil {
+		t.Fatal(err)
+	}
+	simplifyPicture(root)
+	want := "( Picture\n0.750000000\n( * 3.000000000 X )\n0.327194721 )"
+	if got := root.String(); got != want {
+		t.Fatalf("simplified to %s, want %s", got, want)
+	}
+	parsed, err := BeginLexing(want)
+	if err != nil {
+		t.Fatalf("%s does not parse: %v", want, err)
+	}
+	if got := parsed.String(); got != want {
+		t.Fatalf("%s parses as %s", want, got)
+	}
+}
+
+func TestSimplifyRandomTrees(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	changed := 0
+	for i := 0; i < 500; i++ {
+		root := NewOpPicture()
+		for c := range root.Children {
+			root.Children[c] = RandomTree(rng, 30)
+			root.Children[c].SetParent(root)
+		}
+		original := CopyTree(root, nil)
+		simplifyPicture(root)
+		checkParents(t, root)
+		if root.String() != original.String() {
+			changed++
+		}
+
+		parsed, err := BeginLexing(root.String())
+		if err != nil {
+			t.Fatalf("%s does not parse: %v", root, err)
+		}
+		if parsed.String() != root.String() {
+			t.Fatalf("%s parses as %s", root, parsed)
+		}
+
+		for c, channel := range root.GetChildren() {
+			before := original.GetChildren()[c]
+			for _, mode := range []Mode{Standard, Protected} {
+				want, got := Compile(before, mode), Compile(channel, mode)
+				wantRow, gotRow := make([]float32, len(testXs)), make([]float32, len(testXs))
+				for _, ty := range testTs {
+					for _, y := range testYs {
+						want.EvalRow(want.NewRowStack(len(testXs)), testXs, y, ty, wantRow)
+						got.EvalRow(got.NewRowStack(len(testXs)), testXs, y, ty, gotRow)
+						for xi, x := range testXs {
+							if !sameValue(gotRow[xi], wantRow[xi]) {
+								t.Fatalf("%s simplified to %s in %s mode gives %v at (%v, %v, %v), want %v",
+									before, channel, mode, gotRow[xi], x, y, ty, wantRow[xi])
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	if changed == 0 {
+		t.Fatal("no tree was simplified")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"math"
+
+	. "ast"
+)
+
+// unit maps a channel value from the nominal [-1, 1] range of a tree to
+// [0, 1], clamping anything outside it. NaN maps to 0.
+func unit(v float32) float32 {
+	v = (v + 1) / 2
+	if !(v > 0) {
+		return 0
+	} else if v > 1 {
+		return 1
+	}
+	return v
+}
+
+// hue maps a channel value to a hue in [0, 1), wrapping around so that the
+// whole range of a tree shows up as color.
+func hue(v float32) float32 {
+	h := float64(v+1) / 2
+	h -= math.Floor(h)
+	if math.IsNaN(h) || math.IsInf(h, 0) {
+		return 0
+	}
+	return float32(h)
+}
+
+func unitToByte(v float32) byte {
+	return byte(v*255 + 0.5)
+}
+
+// wrapByte scales a channel value from [-1, 1] to a byte, wrapping values
+// outside that range around and giving 0 for those beyond what an int32
+// holds. That is what converting straight to a byte does on amd64, but Go
+// leaves out of range conversions to the implementation.
+func wrapByte(v float32) byte {
+	const scale = float32(255 / 2)
+	scaled := v*scale + scale
+	if !(scaled >= -1<<31 && scaled < 1<<31) {
+		return 0
+	}
+	return byte(int32(scaled))
+}
+
+func hsvToRGB(h, s, v float32) (float32, float32, float32) {
+	h *= 6
+	sector := int(h) % 6
+	f := h - float32(math.Floor(float64(h)))
+	p := v * (1 - s)
+	q := v * (1 - s*f)
+	t := v * (1 - s*(1-f))
+	switch sector {
+	case 0:
+		return v, t, p
+	case 1:
+		return q, v, p
+	case 2:
+		return p, v, t
+	case 3:
+		return p, q, v
+	case 4:
+		return t, p, v
+	default:
+		return v, p, q
+	}
+}
+
+func hslToRGB(h, s, l float32) (float32, float32, float32) {
+	var v float32
+	if l < 0.5 {
+		v = l * (1 + s)
+	} else {
+		v = l + s - l*s
+	}
+	if v == 0 {
+		return 0, 0, 0
+	}
+	return hsvToRGB(h, 2*(v-l)/v, v)
+}
+
+func labToRGB(l, a, b float32) (float32, float32, float32) {
+	// CIE Lab to XYZ under a D65 white point.
+	fy := (float64(l) + 16) / 116
+	fx := fy + float64(a)/500
+	fz := fy - float64(b)/200
+	finv := func(t float64) float64 {
+		if t > 6.0/29 {
+			return t * t * t
+		}
+		return 3 * (6.0 / 29) * (6.0 / 29) * (t - 4.0/29)
+	}
+	x := 0.95047 * finv(fx)
+	y := 1.00000 * finv(fy)
+	z := 1.08883 * finv(fz)
+
+	// XYZ to linear sRGB, then sRGB gamma.
+	gamma := func(c float64) float32 {
+		if c <= 0.0031308 {
+			c *= 12.92
+		} else {
+			c = 1.055*math.Pow(c, 1/2.4) - 0.055
+		}
+		if !(c > 0) {
+			return 0
+		} else if c > 1 {
+			return 1
+		}
+		return float32(c)
+	}
+	return gamma(3.2406*x - 1.5372*y - 0.4986*z),
+		gamma(-0.9689*x + 1.8758*y + 0.0415*z),
+		gamma(0.0557*x - 0.2040*y + 1.0570*z)
+}
+
+// toRGB converts the outputs of a picture's three trees into a pixel in the
+// picture's color space. RGB keeps the original scaling, including its wrap
+// around for values outside [-1, 1], so existing pictures look the same.
+func toRGB(space ColorSpace, c0, c1, c2 float32) (byte, byte, byte) {
+	switch space {
+	case HSV:
+		r, g, b := hsvToRGB(hue(c0), unit(c1), unit(c2))
+		return unitToByte(r), unitToByte(g), unitToByte(b)
+	case HSL:
+		r, g, b := hslToRGB(hue(c0), unit(c1), unit(c2))
+		return unitToByte(r), unitToByte(g), unitToByte(b)
+	case Lab:
+		r, g, b := labToRGB(unit(c0)*100, (unit(c1)*2-1)*128, (unit(c2)*2-1)*128)
+		return unitToByte(r), unitToByte(g), unitToByte(b)
+	case Gray:
+		v := unitToByte(unit(c0))
+		return v, v, v
+	default:
+		return wrapByte(c0), wrapByte(c1), wrapByte(c2)
+	}
+}
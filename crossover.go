@@ -0,0 +1,187 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+
+	. "ast"
+)
+
+// crossover is a strategy for breeding a child from two parents.
+type crossover int
+
+const (
+	// subtreeCrossover grafts a random subtree of any channel of b onto a
+	// random channel of a.
+	subtreeCrossover crossover = iota
+	// channelCrossover takes the first channels from a and the rest from
+	// b, so a's colors can meet b's shapes.
+	channelCrossover
+	// sameChannelCrossover grafts a subtree of b's red channel onto a's
+	// red channel, green onto green and blue onto blue.
+	sameChannelCrossover
+	// sizeFairCrossover grafts a subtree of b about as large as the one of
+	// a it replaces.
+	sizeFairCrossover
+	// blendCrossover makes every channel Lerp(a, b, k) for a random k.
+	blendCrossover
+	numCrossovers
+)
+
+var crossoverNames = [numCrossovers]string{"subtree", "channel", "same-channel", "size-fair", "blend"}
+
+func (c crossover) String() string {
+	return crossoverNames[c]
+}
+
+func parseCrossover(s string) (crossover, bool) {
+	for i, name := range crossoverNames {
+		if name == s {
+			return crossover(i), true
+		}
+	}
+	return subtreeCrossover, false
+}
+
+// breed makes a child of a and b using strategy c and records c in the
+// child's lineage. Parents too large to blend are crossed by subtree
+// instead.
+func (c crossover) breed(rng *rand.Rand, a, b *picture) *picture {
+	var child *picture
+	switch c {
+	case channelCrossover:
+		child = crossChannels(rng, a, b)
+	case blendCrossover:
+		child = crossBlend(rng, a, b)
+		if child == nil {
+			c = subtreeCrossover
+			child = cross(rng, a, b, c)
+		}
+	default:
+		child = cross(rng, a, b, c)
+	}
+	child.lineage.Crossover = c.String()
+	return child
+}
+
+// inheritStops crosses the gradient of palette picture p with that of b,
+// if b is a palette picture too.
+func (p *picture) inheritStops(rng *rand.Rand, b *picture) {
+	if p.isPalette() && b.isPalette() {
+		p.stops = crossStops(rng, p.stops, b.stops)
+		p.record("cross stops")
+	}
+}
+
+// donorChannel returns channel i of p, or its last channel if p has fewer.
+func (p *picture) donorChannel(i int) Node {
+	channels := p.channels()
+	if i >= len(channels) {
+		i = len(channels) - 1
+	}
+	return *channels[i]
+}
+
+// crossChannels copies a and replaces its channels from a random cut point
+// on with b's. Palette pictures have a single channel, which is replaced
+// with one of b's, keeping a's gradient.
+func crossChannels(rng *rand.Rand, a, b *picture) *picture {
+	child := a.copy()
+	child.beginLineage(rng, 0, a, b)
+	channels := child.channels()
+	cut := 0
+	if len(channels) > 1 {
+		cut = 1 + rng.Intn(len(channels)-1)
+	}
+	from := make([]string, len(channels))
+	for i, channel := range channels {
+		from[i] = channelNames[i] + "<-a"
+		if i < cut {
+			continue
+		}
+		j := i
+		if len(channels) == 1 {
+			j = rng.Intn(len(b.channels()))
+		}
+		*channel = CopyTree(b.donorChannel(j), nil)
+		from[i] = channelNames[i] + "<-b"
+	}
+	child.record("channels %s", strings.Join(from, " "))
+	return child
+}
+
+// crossBlend copies a and replaces each channel with a Lerp between it and
+// the matching channel of b, weighted by a random constant. Channels whose
+// blend would break the size limits are kept from a, and if that is all of
+// them crossBlend returns nil.
+func crossBlend(rng *rand.Rand, a, b *picture) *picture {
+	child := a.copy()
+	child.beginLineage(rng, 0, a, b)
+	blended := false
+	for i, channel := range child.channels() {
+		donor := b.donorChannel(i)
+		depth := Depth(*channel)
+		if d := Depth(donor); d > depth {
+			depth = d
+		}
+		if depth+1 > maxDepth || (*channel).NodeCount()+donor.NodeCount()+2 > maxNodes {
+			continue
+		}
+		k := rng.Float32()
+		*channel = Blend(*channel, CopyTree(donor, nil), k)
+		child.record("blend %s %.3f", channelNames[i], k)
+		blended = true
+	}
+	if !blended {
+		return nil
+	}
+	child.inheritStops(rng, b)
+	return child
+}
+
+// pickSizeFair returns a random node of tree whose subtree has between half
+// and twice size nodes, or the one closest to size if there is none, along
+// with its index.
+func pickSizeFair(rng *rand.Rand, tree Node, size int) (Node, int) {
+	nodes, sizes := subtreeSizes(tree)
+	var fair []int
+	closest, closestDiff := 0, -1
+	for i, n := range sizes {
+		if 2*n >= size && n <= 2*size {
+			fair = append(fair, i)
+		}
+		diff := n - size
+		if diff < 0 {
+			diff = -diff
+		}
+		if closestDiff < 0 || diff < closestDiff {
+			closest, closestDiff = i, diff
+		}
+	}
+	index := closest
+	if len(fair) > 0 {
+		index = fair[rng.Intn(len(fair))]
+	}
+	return nodes[index], index
+}
+
+// subtreeSizes returns the nodes of tree in the order GetNthNode counts
+// them and the number of nodes under each, in a single walk.
+func subtreeSizes(tree Node) ([]Node, []int) {
+	var nodes []Node
+	var sizes []int
+	var walk func(node Node) int
+	walk = func(node Node) int {
+		i := len(nodes)
+		nodes = append(nodes, node)
+		sizes = append(sizes, 0)
+		size := 1
+		for _, child := range node.GetChildren() {
+			size += walk(child)
+		}
+		sizes[i] = size
+		return size
+	}
+	walk(tree)
+	return nodes, sizes
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/bits"
+)
+
+// Children closer than duplicateDistance bits of edge hash and
+// duplicateColorDistance in average color to a sibling or survivor are bred
+// again, up to duplicateRetries times per generation. A negative distance
+// turns the check off.
+var duplicateDistance = 4
+var duplicateRetries = 32
+
+const duplicateColorDistance = 16
+
+// fingerprintW x fingerprintH is the size of the render fingerprints are
+// taken from. It is averaged down to 9x8 for the edge hash.
+const fingerprintW, fingerprintH = 18, 16
+
+// fingerprint identifies a picture by its trees and by how it looks.
+type fingerprint struct {
+	structure uint64
+	edges     uint64
+	color     [3]int
+}
+
+func fingerprintOf(p *picture) fingerprint {
+	h := fnv.New64a()
+	h.Write([]byte(p.String()))
+	f := fingerprint{structure: h.Sum64()}
+
+	pixels := ASTToPixels(p, fingerprintW, fingerprintH)
+	var small [8][9]float64
+	for i := 0; i < fingerprintW*fingerprintH*4; i += 4 {
+		x, y := (i/4)%fingerprintW, (i/4)/fingerprintW
+		small[y/2][x/2] += luminance(pixels, i)
+		for c := 0; c < 3; c++ {
+			f.color[c] += int(pixels[i+c])
+		}
+	}
+	for c := range f.color {
+		f.color[c] /= fingerprintW * fingerprintH
+	}
+	// A difference hash: one bit per horizontally adjacent pair of cells,
+	// set where brightness increases.
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			f.edges <<= 1
+			if small[y][x+1] > small[y][x] {
+				f.edges |= 1
+			}
+		}
+	}
+	return f
+}
+
+// similar reports whether f and g are the same trees or look nearly alike.
+func (f fingerprint) similar(g fingerprint) bool {
+	if f.structure == g.structure {
+		return true
+	}
+	if bits.OnesCount64(f.edges^g.edges) > duplicateDistance {
+		return false
+	}
+	for c := range f.color {
+		if d := f.color[c] - g.color[c]; d > duplicateColorDistance || d < -duplicateColorDistance {
+			return false
+		}
+	}
+	return true
+}
+
+// fingerprints is a set of pictures to keep new children apart from.
+type fingerprints []fingerprint
+
+func (fs *fingerprints) add(p *picture) fingerprint {
+	f := fingerprintOf(p)
+	*fs = append(*fs, f)
+	return f
+}
+
+func (fs fingerprints) contains(f fingerprint) bool {
+	for _, g := range fs {
+		if f.similar(g) {
+			return true
+		}
+	}
+	return false
+}
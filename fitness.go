@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// A fitnessFunc scores a rendered w x h RGBA picture. Scores are roughly
+// between 0 and 1 and higher is better.
+type fitnessFunc func(pixels []byte, w, h int) float64
+
+var fitnessFuncs = map[string]fitnessFunc{
+	"entropy":      colorEntropy,
+	"edges":        edgeDensity,
+	"symmetry":     symmetry,
+	"benford":      benford,
+	"colorfulness": colorfulness,
+}
+
+func fitnessNames() string {
+	names := make([]string, 0, len(fitnessFuncs))
+	for name := range fitnessFuncs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// weightedFitness is a weighted sum of fitness functions.
+type weightedFitness struct {
+	names   []string
+	funcs   []fitnessFunc
+	weights []float64
+}
+
+// parseFitness parses a list like "entropy=1,symmetry=0.5".
+func parseFitness(s string) (*weightedFitness, error) {
+	weights, err := parseWeights(s)
+	if err != nil {
+		return nil, err
+	}
+	f := &weightedFitness{}
+	for name := range weights {
+		f.names = append(f.names, name)
+	}
+	sort.Strings(f.names)
+	for _, name := range f.names {
+		fn, ok := fitnessFuncs[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown fitness function %q, want one of %s", name, fitnessNames())
+		}
+		f.funcs = append(f.funcs, fn)
+		f.weights = append(f.weights, weights[name])
+	}
+	return f, nil
+}
+
+func (f *weightedFitness) score(pixels []byte, w, h int) float64 {
+	total := 0.0
+	for i, fn := range f.funcs {
+		total += f.weights[i] * fn(pixels, w, h)
+	}
+	return total
+}
+
+func luminance(pixels []byte, i int) float64 {
+	return 0.299*float64(pixels[i]) + 0.587*float64(pixels[i+1]) + 0.114*float64(pixels[i+2])
+}
+
+// colorEntropy is the Shannon entropy of the picture's colors, quantized to
+// 4 bits per channel, relative to the most a picture can have.
+func colorEntropy(pixels []byte, w, h int) float64 {
+	var histogram [4096]int
+	for i := 0; i < w*h*4; i += 4 {
+		histogram[int(pixels[i]>>4)<<8|int(pixels[i+1]>>4)<<4|int(pixels[i+2]>>4)]++
+	}
+	n := float64(w * h)
+	entropy := 0.0
+	for _, count := range histogram {
+		if count > 0 {
+			p := float64(count) / n
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy / 12
+}
+
+// gradients calls f with the luminance gradient magnitude at every pixel
+// that has a right and a lower neighbor.
+func gradients(pixels []byte, w, h int, f func(magnitude float64)) {
+	for y := 0; y < h-1; y++ {
+		for x := 0; x < w-1; x++ {
+			i := (y*w + x) * 4
+			l := luminance(pixels, i)
+			dx := luminance(pixels, i+4) - l
+			dy := luminance(pixels, i+w*4) - l
+			f(math.Hypot(dx, dy))
+		}
+	}
+}
+
+// edgeDensity is the fraction of pixels on a noticeable luminance edge.
+func edgeDensity(pixels []byte, w, h int) float64 {
+	if w < 2 || h < 2 {
+		return 0
+	}
+	edges := 0
+	gradients(pixels, w, h, func(magnitude float64) {
+		if magnitude > 24 {
+			edges++
+		}
+	})
+	return float64(edges) / float64((w-1)*(h-1))
+}
+
+// symmetry compares the picture with its mirror images, left to right and
+// top to bottom, and scores the closer of the two.
+func symmetry(pixels []byte, w, h int) float64 {
+	var horizontal, vertical float64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := (y*w + x) * 4
+			mx := (y*w + w - 1 - x) * 4
+			my := ((h-1-y)*w + x) * 4
+			for c := 0; c < 3; c++ {
+				horizontal += math.Abs(float64(pixels[i+c]) - float64(pixels[mx+c]))
+				vertical += math.Abs(float64(pixels[i+c]) - float64(pixels[my+c]))
+			}
+		}
+	}
+	diff := math.Min(horizontal, vertical) / float64(w*h*3*255)
+	return 1 - diff
+}
+
+// benfordLaw is the expected share of each leading digit 1 to 9.
+var benfordLaw = [9]float64{0.301, 0.176, 0.125, 0.097, 0.079, 0.067, 0.058, 0.051, 0.046}
+
+// benford scores how closely the leading digits of the picture's gradient
+// magnitudes follow Benford's law, which those of natural images tend to.
+// A flat picture has no gradients and scores 0.
+func benford(pixels []byte, w, h int) float64 {
+	var digits [9]float64
+	total := 0.0
+	gradients(pixels, w, h, func(magnitude float64) {
+		if magnitude < 1 {
+			return
+		}
+		for magnitude >= 10 {
+			magnitude /= 10
+		}
+		digits[int(magnitude)-1]++
+		total++
+	})
+	if total == 0 {
+		return 0
+	}
+	distance := 0.0
+	for d, expected := range benfordLaw {
+		distance += math.Abs(digits[d]/total - expected)
+	}
+	return 1 - distance/2
+}
+
+// colorfulness is the Hasler and Süsstrunk colorfulness metric, where 109
+// and above counts as extremely colorful.
+func colorfulness(pixels []byte, w, h int) float64 {
+	var sumRG, sumYB, sumRG2, sumYB2 float64
+	for i := 0; i < w*h*4; i += 4 {
+		r, g, b := float64(pixels[i]), float64(pixels[i+1]), float64(pixels[i+2])
+		rg := r - g
+		yb := (r+g)/2 - b
+		sumRG += rg
+		sumYB += yb
+		sumRG2 += rg * rg
+		sumYB2 += yb * yb
+	}
+	n := float64(w * h)
+	meanRG, meanYB := sumRG/n, sumYB/n
+	varRG, varYB := sumRG2/n-meanRG*meanRG, sumYB2/n-meanYB*meanYB
+	m := math.Sqrt(math.Max(varRG+varYB, 0)) + 0.3*math.Sqrt(meanRG*meanRG+meanYB*meanYB)
+	return math.Min(m/109, 1)
+}
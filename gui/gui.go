@@ -42,8 +42,11 @@ type ImageButton struct {
 	Rect            sdl.Rect
 	WasLeftClicked  bool
 	WasRightClicked bool
-	IsSelected      bool
-	SelectedTex     *sdl.Texture
+	IsHovered       bool
+	// Weight is how much the picture is preferred, 0 if it is not
+	// selected. The border grows thicker with it.
+	Weight      int
+	SelectedTex *sdl.Texture
 }
 
 func NewImageButton(renderer *sdl.Renderer, image *sdl.Texture, rect sdl.Rect, selectedColor sdl.Color) *ImageButton {
@@ -58,11 +61,12 @@ func NewImageButton(renderer *sdl.Renderer, image *sdl.Texture, rect sdl.Rect, s
 	pixels[2] = selectedColor.B
 	pixels[3] = selectedColor.A
 	tex.Update(nil, pixels, 4)
-	return &ImageButton{image, rect, false, false, false, tex}
+	return &ImageButton{image, rect, false, false, false, 0, tex}
 }
 
 func (button *ImageButton) Update(mouseState *MouseState) {
-	if button.Rect.HasIntersection(&sdl.Rect{int32(mouseState.X), int32(mouseState.Y), 1, 1}) {
+	button.IsHovered = button.Rect.HasIntersection(&sdl.Rect{int32(mouseState.X), int32(mouseState.Y), 1, 1})
+	if button.IsHovered {
 		button.WasLeftClicked = mouseState.PrevLeftButton && !mouseState.LeftButton
 		button.WasRightClicked = mouseState.PrevRightButton && !mouseState.RightButton
 	} else {
@@ -73,9 +77,9 @@ func (button *ImageButton) Update(mouseState *MouseState) {
 
 func (button *ImageButton) Draw(renderer *sdl.Renderer) {
 
-	if button.IsSelected {
+	if button.Weight > 0 {
 		borderRect := button.Rect
-		borderThickness := int32(float32(borderRect.W) * .01)
+		borderThickness := int32(float32(borderRect.W) * .008 * float32(button.Weight))
 		borderRect.W = button.Rect.W + borderThickness*2
 		borderRect.H = button.Rect.H + borderThickness*2
 		borderRect.X -= borderThickness
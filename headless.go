@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+)
+
+// renderAll renders every picture in pics at w x h.
+func renderAll(scheduler *renderScheduler, pics []*picture, w, h int) [][]byte {
+	results := make(chan pixelResult, len(pics))
+	for i, pic := range pics {
+		scheduler.submit(context.Background(), pic, w, h, 0, i, 0, false, results)
+	}
+	pixels := make([][]byte, len(pics))
+	for range pics {
+		result := <-results
+		pixels[result.index] = result.pixels
+	}
+	return pixels
+}
+
+// tournament picks size random entries of scores and returns the index of
+// the best one.
+func tournament(rng *rand.Rand, scores []float64, size int) int {
+	best := rng.Intn(len(scores))
+	for i := 1; i < size; i++ {
+		if c := rng.Intn(len(scores)); scores[c] > scores[best] {
+			best = c
+		}
+	}
+	return best
+}
+
+// pickParents picks a parent for every picture by tournament, except that
+// the best elites pictures take the first places, so evolve carries them
+// over.
+func pickParents(rng *rand.Rand, pics []*picture, scores []float64, tournamentSize int) []*picture {
+	parents := make([]*picture, len(pics))
+	i := 0
+	if elites > 0 {
+		order := make([]int, len(pics))
+		for j := range order {
+			order[j] = j
+		}
+		sort.SliceStable(order, func(a, b int) bool { return scores[order[a]] > scores[order[b]] })
+		for ; i < elites && i < len(parents); i++ {
+			parents[i] = pics[order[i]]
+		}
+	}
+	for ; i < len(parents); i++ {
+		parents[i] = pics[tournament(rng, scores, tournamentSize)]
+	}
+	return parents
+}
+
+func evolveCommand(args []string) error {
+	fs := flag.NewFlagSet("evolve", flag.ExitOnError)
+	generations := fs.Int("generations", 50, "number of generations to breed")
+	fsRows := fs.Int("rows", rows, "rows of the population grid")
+	fsCols := fs.Int("cols", cols, "columns of the population grid")
+	tournamentSize := fs.Int("tournament", 3, "pictures competing for each parent slot")
+	fitnessFlag := fs.String("fitness", "entropy=1,benford=1,colorfulness=1", "weighted fitness functions, from "+fitnessNames())
+	size := fs.Int("size", 96, "width in pixels pictures are scored at")
+	w := fs.Int("w", winWidth/2, "width of the saved pngs")
+	h := fs.Int("h", winHeight/2, "height of the saved pngs")
+	keep := fs.Int("keep", 1, "number of best pictures saved each generation")
+	out := fs.String("o", "evolved", "output directory")
+	seedFlag := fs.Int64("seed", 0, "seed for the run's random numbers (default: from the clock)")
+	sessionFlag := fs.String("session", "", "start from the population of this session instead of a random one")
+	settings := addEvolutionFlags(fs)
+	migration := addIslandFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: evim evolve [-generations n] [-fitness name=weight,...] [-o dir] [flags]")
+		fs.PrintDefaults()
+	}
+
+	if len(parseInterspersed(fs, args)) != 0 {
+		fs.Usage()
+		return errors.New("evolve takes no positional arguments")
+	}
+	if *generations < 0 || *tournamentSize < 1 || *size <= 0 || *w <= 0 || *h <= 0 || *keep < 0 {
+		return errors.New("invalid evolve settings")
+	}
+	scoreW, scoreH := *size, *size*winHeight/winWidth
+	if scoreH < 1 {
+		return fmt.Errorf("size must be at least %d to give pictures a height", (winWidth+winHeight-1)/winHeight)
+	}
+	fitness, err := parseFitness(*fitnessFlag)
+	if err != nil {
+		return err
+	}
+	_, _, strategy, err := settings.apply()
+	if err != nil {
+		return err
+	}
+	if err := applyIslandFlags(*migration); err != nil {
+		return err
+	}
+
+	seed := runSeed(fs, *seedFlag)
+	var islands []*generationState
+	if *sessionFlag != "" {
+		s, loaded, err := loadSession(*sessionFlag)
+		if err != nil {
+			return err
+		}
+		s.apply()
+		seed, islands = s.Seed, loaded
+		if s.Settings != nil {
+			if strategy, err = s.Settings.restore(fs, strategy); err != nil {
+				return err
+			}
+		}
+	} else {
+		if *fsRows < 1 || *fsCols < 1 {
+			return errors.New("invalid population grid")
+		}
+		rows, cols, numPics = *fsRows, *fsCols, *fsRows**fsCols
+		for k := 0; k < numIslands; k++ {
+			rng := generationRand(islandSeed(seed, k), 0)
+			pics := make([]*picture, numPics)
+			for i := range pics {
+				pics[i] = NewPicture(rng)
+			}
+			islands = append(islands, &generationState{0, pics, make([]int, numPics)})
+		}
+	}
+	if *keep > numPics {
+		*keep = numPics
+	}
+	fmt.Println("seed", seed)
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		return err
+	}
+
+	scheduler := newRenderScheduler(runtime.NumCPU())
+	for step := 0; ; step++ {
+		// Every island is scored and bred before any migrate, so migrants
+		// come from the generation the islands have just left.
+		next := make([]*generationState, len(islands))
+		rngs := make([]*rand.Rand, len(islands))
+		for k, state := range islands {
+			pics := state.pictures
+			pixels := renderAll(scheduler, pics, scoreW, scoreH)
+			scores := make([]float64, len(pics))
+			mean := 0.0
+			for i := range pics {
+				scores[i] = fitness.score(pixels[i], scoreW, scoreH)
+				mean += scores[i]
+			}
+			mean /= float64(len(scores))
+			order := make([]int, len(pics))
+			for i := range order {
+				order[i] = i
+			}
+			sort.SliceStable(order, func(i, j int) bool { return scores[order[i]] > scores[order[j]] })
+			prefix := ""
+			if len(islands) > 1 {
+				prefix = fmt.Sprintf("island%d_", k+1)
+				fmt.Printf("island %d, ", k+1)
+			}
+			fmt.Printf("generation %d: best %.4f, mean %.4f\n", state.generation, scores[order[0]], mean)
+
+			// The best pictures count as selected, both for migration
+			// and in the saved session.
+			state.weights = make([]int, len(pics))
+			best := make([]*picture, *keep)
+			for i := range best {
+				best[i] = pics[order[i]]
+				state.weights[order[i]] = 1
+			}
+			for i, img := range renderAll(scheduler, best, *w, *h) {
+				name := filepath.Join(*out, fmt.Sprintf("%sgen%04d_%d", prefix, state.generation, i+1))
+				if err := ioutil.WriteFile(name+".apt", []byte(best[i].simplified().String()), 0644); err != nil {
+					return err
+				}
+				if best[i].lineage != nil {
+					if err := saveGenealogy(name+".lineage", genealogyOf(best[i], seed)); err != nil {
+						return err
+					}
+				}
+				if err := savePNG(name+".png", img, *w, *h); err != nil {
+					return err
+				}
+			}
+
+			if step == *generations {
+				continue
+			}
+			generation := state.generation + 1
+			rngs[k] = generationRand(islandSeed(seed, k), generation)
+			parents := pickParents(rngs[k], pics, scores, *tournamentSize)
+			next[k] = &generationState{generation, evolve(rngs[k], parents, nil, generation, strategy), make([]int, len(pics))}
+		}
+		if step == *generations {
+			break
+		}
+		for k := range next {
+			if migrationDue(next[k].generation) {
+				from := (k + len(islands) - 1) % len(islands)
+				next[k] = migrate(rngs[k], pickMigrants(rngs[k], islands[from], migrants, migrateSelected), from, next[k])
+			}
+		}
+		islands = next
+		var pics []*picture
+		for _, state := range islands {
+			pics = append(pics, state.pictures...)
+		}
+		pruneLineage(pics)
+	}
+
+	// The final population is saved with its best pictures selected, ready
+	// to be resumed in the evolution window with --session.
+	sessionPath := filepath.Join(*out, "evolved.session")
+	if err := saveSession(sessionPath, newSession(seed, islands, 0, strategy)); err != nil {
+		return err
+	}
+	fmt.Println("saved the final population to", sessionPath)
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+// maxHistory is how many generations the grid keeps for undo.
+const maxHistory = 32
+
+// generationState is one population as shown in the grid. weights are
+// the preference weights given to its pictures, 0 for those not selected.
+type generationState struct {
+	generation int
+	pictures   []*picture
+	weights    []int
+}
+
+// history is a bounded stack of populations for stepping back and forward
+// through generations. Evolving from an earlier generation branches: the
+// generations after it are dropped.
+type history struct {
+	states  []*generationState
+	current int
+}
+
+func newHistory(first *generationState) *history {
+	return &history{[]*generationState{first}, 0}
+}
+
+func (h *history) top() *generationState {
+	return h.states[h.current]
+}
+
+// push makes s the current generation, discarding any generations that were
+// stepped back over and the oldest one if the stack is full.
+func (h *history) push(s *generationState) {
+	h.states = append(h.states[:h.current+1], s)
+	if len(h.states) > maxHistory {
+		h.states = h.states[1:]
+	}
+	h.current = len(h.states) - 1
+}
+
+// back returns the previous generation, or nil if there is none.
+func (h *history) back() *generationState {
+	if h.current == 0 {
+		return nil
+	}
+	h.current--
+	return h.states[h.current]
+}
+
+// forward returns the generation that was stepped back from, or nil if
+// there is none.
+func (h *history) forward() *generationState {
+	if h.current == len(h.states)-1 {
+		return nil
+	}
+	h.current++
+	return h.states[h.current]
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// Islands are populations that evolve apart from each other, so several
+// looks can be kept alive at once. They form a ring: every migrateEvery
+// generations an island takes in migrants pictures from the island before
+// it. With migrateSelected the migrants are the selected pictures of that
+// island, those with the highest weights first, or random ones when none
+// are selected. Each island counts its own generations, so in the window,
+// where only the island shown is evolved, an island takes in migrants when
+// it is evolved to a multiple of migrateEvery. A migrateEvery of 0 turns
+// the periodic migration off.
+var numIslands = 1
+var migrateEvery = 5
+var migrants = 2
+var migrateSelected = true
+
+func addIslandFlags(fs *flag.FlagSet) *string {
+	fs.IntVar(&numIslands, "islands", numIslands, "number of populations evolving apart from each other")
+	fs.IntVar(&migrateEvery, "migrate-every", migrateEvery, "generations of an island between migrations into it, counted for each island on its own; 0 for none")
+	fs.IntVar(&migrants, "migrants", migrants, "most pictures that migrate at a time")
+	return fs.String("migrate", "selected", "which pictures migrate: selected or random")
+}
+
+// applyIslandFlags checks the island settings and the value of the flag
+// returned by addIslandFlags.
+func applyIslandFlags(migrate string) error {
+	switch migrate {
+	case "selected":
+		migrateSelected = true
+	case "random":
+		migrateSelected = false
+	default:
+		return fmt.Errorf("unknown migration %q, want selected or random", migrate)
+	}
+	if numIslands < 1 || migrateEvery < 0 || migrants < 0 {
+		return errors.New("invalid island settings")
+	}
+	return nil
+}
+
+// islandSeed derives the seed an island is bred from. The first island
+// uses the run's seed, so runs with one island are the same as before.
+func islandSeed(seed int64, island int) int64 {
+	return seed + int64(island)*0x2545f4914f6cdd1d
+}
+
+// migrationDue reports whether an island that just reached generation
+// takes in migrants.
+func migrationDue(generation int) bool {
+	return numIslands > 1 && migrateEvery > 0 && generation%migrateEvery == 0
+}
+
+// pickMigrants returns up to count pictures of from: its selected ones,
+// highest weights first, when selectedOnly is set and any are selected,
+// otherwise random ones.
+func pickMigrants(rng *rand.Rand, from *generationState, count int, selectedOnly bool) []*picture {
+	var picked []*picture
+	if selectedOnly {
+		var selected []int
+		for _, i := range rng.Perm(len(from.pictures)) {
+			if from.weights[i] > 0 {
+				selected = append(selected, i)
+			}
+		}
+		sort.SliceStable(selected, func(i, j int) bool { return from.weights[selected[i]] > from.weights[selected[j]] })
+		for _, i := range selected {
+			picked = append(picked, from.pictures[i])
+		}
+	}
+	if len(picked) == 0 {
+		for _, i := range rng.Perm(len(from.pictures)) {
+			picked = append(picked, from.pictures[i])
+		}
+	}
+	if len(picked) > count {
+		picked = picked[:count]
+	}
+	return picked
+}
+
+// migrate returns a copy of the population to with copies of migrants in
+// place of random pictures of it. Selected pictures of to are kept, so
+// fewer migrants than given may arrive. The migrants' lineage names the
+// island they came from.
+func migrate(rng *rand.Rand, migrants []*picture, from int, to *generationState) *generationState {
+	s := &generationState{to.generation, append([]*picture(nil), to.pictures...), append([]int(nil), to.weights...)}
+	var free []int
+	for _, i := range rng.Perm(len(s.pictures)) {
+		if s.weights[i] == 0 {
+			free = append(free, i)
+		}
+	}
+	for k, migrant := range migrants {
+		if k == len(free) {
+			break
+		}
+		p := migrant.copy()
+		p.beginLineage(rng, to.generation, migrant)
+		p.record("migrate from island %d", from+1)
+		p.finishLineage()
+		s.pictures[free[k]] = p
+	}
+	return s
+}
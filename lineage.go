@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "ast"
+)
+
+var channelNames = []string{"r", "g", "b"}
+
+// lineage records where a picture came from: its parents, the generation
+// it was born in, the crossover strategy that made it and every crossover
+// and mutation applied to it.
+type lineage struct {
+	ID         string   `json:"id"`
+	Parents    []string `json:"parents,omitempty"`
+	Generation int      `json:"generation"`
+	Crossover  string   `json:"crossover,omitempty"`
+	Ops        []string `json:"ops,omitempty"`
+	Tree       string   `json:"tree"`
+}
+
+// lineageBook holds the lineage of the pictures bred in this session, so
+// the ancestry of a saved picture can be written out with it. Records no
+// living picture descends from are dropped by pruneLineage.
+var lineageBook = make(map[string]*lineage)
+
+func newID(rng *rand.Rand) string {
+	return fmt.Sprintf("%016x", rng.Uint64())
+}
+
+// beginLineage gives p a fresh ID descended from parents.
+func (p *picture) beginLineage(rng *rand.Rand, generation int, parents ...*picture) {
+	p.lineage = &lineage{ID: newID(rng), Generation: generation}
+	for _, parent := range parents {
+		if parent.lineage != nil {
+			p.lineage.Parents = append(p.lineage.Parents, parent.lineage.ID)
+		}
+	}
+}
+
+func (p *picture) record(format string, args ...interface{}) {
+	if p.lineage != nil {
+		p.lineage.Ops = append(p.lineage.Ops, fmt.Sprintf(format, args...))
+	}
+}
+
+// finishLineage stores p in the lineage book once it will not change any
+// more.
+func (p *picture) finishLineage() {
+	if p.lineage != nil {
+		p.lineage.Tree = p.String()
+		lineageBook[p.lineage.ID] = p.lineage
+	}
+}
+
+// genealogy is the lineage of one picture and all of its known ancestors,
+// as saved next to an .apt file, with the seed of the run that bred it.
+type genealogy struct {
+	Picture string     `json:"picture"`
+	Seed    int64      `json:"seed"`
+	Records []*lineage `json:"records"`
+}
+
+func genealogyOf(p *picture, seed int64) *genealogy {
+	return &genealogy{Picture: p.lineage.ID, Seed: seed, Records: ancestry([]*picture{p})}
+}
+
+// ancestry returns the lineage of pics and of all their known ancestors,
+// each record once, nearest first.
+func ancestry(pics []*picture) []*lineage {
+	var records []*lineage
+	var queue []*lineage
+	for _, p := range pics {
+		if p.lineage != nil {
+			queue = append(queue, p.lineage)
+		}
+	}
+	seen := make(map[string]bool)
+	for len(queue) > 0 {
+		record := queue[0]
+		queue = queue[1:]
+		if seen[record.ID] {
+			continue
+		}
+		seen[record.ID] = true
+		records = append(records, record)
+		for _, parent := range record.Parents {
+			if parentRecord, ok := lineageBook[parent]; ok {
+				queue = append(queue, parentRecord)
+			}
+		}
+	}
+	return records
+}
+
+// pruneLineage drops the records of lineageBook that are not in the
+// ancestry of pics, so the book does not grow for as long as a run lasts.
+func pruneLineage(pics []*picture) {
+	keep := make(map[string]bool)
+	for _, record := range ancestry(pics) {
+		keep[record.ID] = true
+	}
+	for id := range lineageBook {
+		if !keep[id] {
+			delete(lineageBook, id)
+		}
+	}
+}
+
+func saveGenealogy(path string, g *genealogy) error {
+	data, err := json.MarshalIndent(g, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func loadGenealogy(path string) (*genealogy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	g := &genealogy{}
+	if err := json.Unmarshal(data, g); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return g, nil
+}
+
+// dotQuote quotes an ID or a file name for Graphviz, which only escapes
+// quotes in them.
+func dotQuote(s string) string {
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+// labelEscaper escapes text for a Graphviz label, where a backslash starts
+// an escape and \n is a line break.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`)
+
+// dotLabel quotes lines as a Graphviz label with one line each.
+func dotLabel(lines []string) string {
+	escaped := make([]string, len(lines))
+	for i, line := range lines {
+		escaped[i] = labelEscaper.Replace(line)
+	}
+	return `"` + strings.Join(escaped, `\n`) + `"`
+}
+
+// writeDOT writes g as a Graphviz graph with ancestors above descendants.
+// thumbs maps record IDs to thumbnail image paths and may be empty.
+func writeDOT(path string, g *genealogy, thumbs map[string]string) error {
+	var b strings.Builder
+	b.WriteString("digraph lineage {\n")
+	fmt.Fprintf(&b, "\tlabel=\"seed %d\";\n", g.Seed)
+	b.WriteString("\tnode [shape=box, labelloc=b, fontsize=10];\n")
+	for _, record := range g.Records {
+		lines := []string{record.ID, fmt.Sprintf("generation %d", record.Generation)}
+		if record.Crossover != "" {
+			lines = append(lines, record.Crossover+" crossover")
+		}
+		lines = append(lines, record.Ops...)
+		attrs := "label=" + dotLabel(lines)
+		if thumb, ok := thumbs[record.ID]; ok {
+			attrs += ", image=" + dotQuote(thumb)
+		}
+		if record.ID == g.Picture {
+			attrs += ", penwidth=3"
+		}
+		fmt.Fprintf(&b, "\t%s [%s];\n", dotQuote(record.ID), attrs)
+	}
+	for _, record := range g.Records {
+		for _, parent := range record.Parents {
+			fmt.Fprintf(&b, "\t%s -> %s;\n", dotQuote(parent), dotQuote(record.ID))
+		}
+	}
+	b.WriteString("}\n")
+	return ioutil.WriteFile(path, []byte(b.String()), 0644)
+}
+
+func lineageCommand(args []string) error {
+	fs := flag.NewFlagSet("lineage", flag.ExitOnError)
+	out := fs.String("o", "", "output .dot file (default: input name with .dot extension)")
+	thumbDir := fs.String("thumbs", "", "directory for thumbnails (default: input name with _thumbs suffix, \"none\" to skip)")
+	size := fs.Int("size", 96, "thumbnail width in pixels")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: evim lineage 3.lineage [-o out.dot] [-thumbs dir] [-size px]")
+		fs.PrintDefaults()
+	}
+
+	inputs := parseInterspersed(fs, args)
+	if len(inputs) != 1 {
+		fs.Usage()
+		return errors.New("lineage needs exactly one .lineage file")
+	}
+	w, h := *size, *size*winHeight/winWidth
+	if w < 2 || h < 1 {
+		least := (winWidth + winHeight - 1) / winHeight
+		if least < 2 {
+			least = 2
+		}
+		return fmt.Errorf("size must be at least %d to give thumbnails a height", least)
+	}
+	in := inputs[0]
+	base := strings.TrimSuffix(in, filepath.Ext(in))
+	outPath := *out
+	if outPath == "" {
+		outPath = base + ".dot"
+	}
+	dir := *thumbDir
+	if dir == "" {
+		dir = base + "_thumbs"
+	}
+
+	g, err := loadGenealogy(in)
+	if err != nil {
+		return err
+	}
+
+	thumbs := make(map[string]string)
+	if dir != "none" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		for _, record := range g.Records {
+			node, err := BeginLexing(record.Tree)
+			if err != nil {
+				return fmt.Errorf("%s: picture %s: %v", in, record.ID, err)
+			}
+			thumb := filepath.Join(dir, record.ID+".png")
+			if err := savePNG(thumb, ASTToPixels(pictureFromNode(node), w, h), w, h); err != nil {
+				return err
+			}
+			thumbs[record.ID] = thumb
+		}
+	}
+	return writeDOT(outPath, g, thumbs)
+}
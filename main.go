@@ -1,166 +1,418 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"strconv"
 	"strings"
 	"time"
-	"github.com/veandco/go-sdl2/sdl"
      ."ast"
-     ."gui"
+	noise "github.com/Go_Projects/simplex_noise"
 )
 
 var winWidth, winHeight = 1280, 720
 var rows, cols, numPics int = 4, 4, rows * cols
 
-type pixelResult struct {
-	pixels []byte
-	index  int
-}
+// One in colorSpaceMutationChance children gets a new random color space.
+const colorSpaceMutationChance = 12
+
+// One in paletteChance new pictures is a palette picture, and one in
+// stopMutationChance palette children has its gradient mutated.
+const paletteChance = 4
+const stopMutationChance = 3
+
+// Channel trees are kept to at most maxDepth levels and maxNodes nodes so
+// rendering does not slow down as pictures grow over the generations. With
+// shrinkBias set, crossover prefers small subtrees and half of all
+// mutations hoist a child into its parent's place.
+var maxDepth, maxNodes = 16, 200
+var shrinkBias = false
+
+// Clicking a picture in the grid raises its weight as a parent up to
+// maxWeight.
+const maxWeight = 5
 
-type guiState struct {
-	zoom      bool
-	zoomImage *sdl.Texture
-	zoomTree  *picture
+// The first elites survivors are carried over to the next generation
+// unchanged. With mutantsOnly set, children are mutations of a single
+// parent instead of crossovers of two.
+var elites = 0
+var mutantsOnly = false
+
+// treeRetries is how many times new trees and crossovers are redrawn when
+// they break the limits before the result is trimmed instead.
+const treeRetries = 8
+
+type pixelResult struct {
+	pixels     []byte
+	index      int
+	generation int
 }
 
 type rgba struct {
 	r, g, b byte
 }
 
+// picture is either three channel trees interpreted in a color space, or a
+// palette picture: one scalar tree in r whose value is looked up in a
+// gradient made from stops. Palette pictures leave g and b nil.
 type picture struct {
-	r Node
-	g Node
-	b Node
+	r       Node
+	g       Node
+	b       Node
+	space   ColorSpace
+	stops   []GradientStop
+	mode    Mode
+	lineage *lineage
 }
 
-func (p *picture) String() string {
-	return "( Picture\n" + p.r.String() + "\n" + p.g.String() + "\n" + p.b.String() + " )"
+func (p *picture) isPalette() bool {
+	return p.stops != nil
 }
 
-func NewPicture() *picture {
-	p := &picture{}
-
-	p.r = GetRandomBaseNode()
-	p.g = GetRandomBaseNode()
-	p.b = GetRandomBaseNode()
-
-	num := rand.Intn(15)
-	for i := 0; i < num; i++ {
-		p.r.AddRandom(GetRandomBaseNode())
+// channels returns pointers to the trees p evaluates, so callers can
+// replace a whole tree.
+func (p *picture) channels() []*Node {
+	if p.isPalette() {
+		return []*Node{&p.r}
 	}
+	return []*Node{&p.r, &p.g, &p.b}
+}
 
-	num = rand.Intn(15)
-	for i := 0; i < num; i++ {
-		p.g.AddRandom(GetRandomBaseNode())
+func (p *picture) String() string {
+	if p.isPalette() {
+		root := NewOpPalette()
+		root.Stops = p.stops
+		root.Mode = p.mode
+		root.Children[0] = p.r
+		return root.String()
 	}
+	root := NewOpPicture()
+	root.Space = p.space
+	root.Mode = p.mode
+	root.Children[0], root.Children[1], root.Children[2] = p.r, p.g, p.b
+	return root.String()
+}
 
-	num = rand.Intn(15)
-	for i := 0; i < num; i++ {
-		p.b.AddRandom(GetRandomBaseNode())
+func randomTree(rng *rand.Rand) Node {
+	for i := 0; ; i++ {
+		node := RandomTree(rng, 15)
+		if withinLimits(node) || i == treeRetries {
+			return Limit(rng, node, maxDepth, maxNodes)
+		}
 	}
+}
 
-	for p.r.AddLeaf(GetRandomLeaf()) {
+func withinLimits(node Node) bool {
+	return Depth(node) <= maxDepth && node.NodeCount() <= maxNodes
+}
 
+// size returns the depth of the deepest channel tree of p and the number of
+// nodes in all of them.
+func (p *picture) size() (depth, nodes int) {
+	for _, channel := range p.channels() {
+		if d := Depth(*channel); d > depth {
+			depth = d
+		}
+		nodes += (*channel).NodeCount()
 	}
+	return depth, nodes
+}
 
-	for p.g.AddLeaf(GetRandomLeaf()) {
-
+// NewPicture draws a random picture, drawing again up to qualityRetries
+// times if it does not pass the quality gate.
+func NewPicture(rng *rand.Rand) *picture {
+	var p *picture
+	for i := 0; ; i++ {
+		p = &picture{}
+		if protectNewPictures {
+			p.mode = Protected
+		}
+		if rng.Intn(paletteChance) == 0 {
+			p.r = randomTree(rng)
+			p.stops = randomStops(rng)
+		} else {
+			p.space = ColorSpace(rng.Intn(int(NumColorSpaces)))
+			p.r = randomTree(rng)
+			p.g = randomTree(rng)
+			p.b = randomTree(rng)
+		}
+		if i >= qualityRetries || passesQualityGate(p) {
+			break
+		}
 	}
 
-	for p.b.AddLeaf(GetRandomLeaf()) {
+	p.beginLineage(rng, 0)
+	p.finishLineage()
+	return p
+
+}
 
+func (p *picture) copy() *picture {
+	c := &picture{space: p.space, mode: p.mode}
+	if p.isPalette() {
+		c.stops = append([]GradientStop(nil), p.stops...)
 	}
+	cChannels := c.channels()
+	for i, channel := range p.channels() {
+		*cChannels[i] = CopyTree(*channel, nil)
+	}
+	return c
+}
 
-	return p
+// simplifyTrees simplifies the trees of pictures before they are rendered
+// or saved as .apt files. They look the same either way, so this only saves
+// time and space; the population keeps the trees it was bred with.
+var simplifyTrees = false
 
+// simplified returns a copy of p with simplified trees, or p itself if
+// simplifyTrees is off.
+func (p *picture) simplified() *picture {
+	if !simplifyTrees {
+		return p
+	}
+	c := p.copy()
+	for _, channel := range c.channels() {
+		*channel = Simplify(*channel)
+	}
+	return c
 }
 
-func (p *picture) pickRandomColor() Node {
-	r := rand.Intn(3)
-	switch r {
-	case 0:
-		return p.r
-	case 1:
-		return p.g
-	case 2:
-		return p.b
-	default:
-		panic("pickRandomColor failed")
-	}
+// pickRandomColor returns the index of a random channel of p and a pointer
+// to its tree.
+func (p *picture) pickRandomColor(rng *rand.Rand) (int, *Node) {
+	channels := p.channels()
+	i := rng.Intn(len(channels))
+	return i, channels[i]
 }
 
-func cross(a *picture, b *picture) *picture {
-	aCopy := &picture{CopyTree(a.r, nil), CopyTree(a.g, nil), CopyTree(a.b, nil)}
-	aColor := aCopy.pickRandomColor()
-	bColor := b.pickRandomColor()
+// cross copies a and replaces a random subtree of it with a copy of a
+// subtree of b. The subtree, same-channel and size-fair strategies differ
+// in which subtree of b is picked. Subtrees that would break the size
+// limits are drawn again a few times before the child is trimmed. The
+// child's lineage names both parents.
+func cross(rng *rand.Rand, a *picture, b *picture, strategy crossover) *picture {
+	aCopy := a.copy()
+	aCopy.beginLineage(rng, 0, a, b)
+	aChannelIndex, aChannel := aCopy.pickRandomColor(rng)
+	aColor := *aChannel
+	var bChannelIndex int
+	var bChannel *Node
+	if strategy == sameChannelCrossover {
+		bChannelIndex = aChannelIndex
+		if bChannels := b.channels(); bChannelIndex >= len(bChannels) {
+			bChannelIndex = len(bChannels) - 1
+		}
+		bChannel = b.channels()[bChannelIndex]
+	} else {
+		bChannelIndex, bChannel = b.pickRandomColor(rng)
+	}
+	bColor := *bChannel
 
-	aIndex := rand.Intn(aColor.NodeCount())
-	aNode, _ := GetNthNode(aColor, aIndex, 0)
+	var aIndex, bIndex int
+	var aNode, bNode Node
+	for i := 0; ; i++ {
+		aIndex = rng.Intn(aColor.NodeCount())
+		aNode, _ = GetNthNode(aColor, aIndex, 0)
 
-	bIndex := rand.Intn(bColor.NodeCount())
-	bNode, _ := GetNthNode(bColor, bIndex, 0)
+		if strategy == sizeFairCrossover {
+			bNode, bIndex = pickSizeFair(rng, bColor, aNode.NodeCount())
+		} else {
+			bIndex = rng.Intn(bColor.NodeCount())
+			bNode, _ = GetNthNode(bColor, bIndex, 0)
+		}
+		if shrinkBias {
+			otherIndex := rng.Intn(bColor.NodeCount())
+			if other, _ := GetNthNode(bColor, otherIndex, 0); other.NodeCount() < bNode.NodeCount() {
+				bIndex, bNode = otherIndex, other
+			}
+		}
+
+		if Level(aNode)+Depth(bNode) <= maxDepth && aColor.NodeCount()-aNode.NodeCount()+bNode.NodeCount() <= maxNodes {
+			break
+		}
+		if i == treeRetries {
+			break
+		}
+	}
 	bNodeCopy := CopyTree(bNode, bNode.GetParent())
 
 	ReplaceNode(aNode, bNodeCopy)
+	if aNode == aColor {
+		*aChannel = bNodeCopy
+	}
+	*aChannel = Limit(rng, *aChannel, maxDepth, maxNodes)
+	aCopy.record("cross %s[%d] <- %s[%d]", channelNames[aChannelIndex], aIndex, channelNames[bChannelIndex], bIndex)
+	aCopy.inheritStops(rng, b)
 	return aCopy
 }
 
-func evolve(survivors []*picture) []*picture {
-	newPics := make([]*picture, numPics)
-	i := 0
-	for i < len(survivors) {
-		a := survivors[i]
-		b := survivors[rand.Intn(len(survivors))]
-		newPics[i] = cross(a, b)
-		i++
-	}
-	for i < len(newPics) {
-		a := survivors[rand.Intn(len(survivors))]
-		b := survivors[rand.Intn(len(survivors))]
-		newPics[i] = cross(a, b)
+// generationRand returns the random source used to breed the given
+// generation of a run. Deriving it from the run's seed and the generation
+// means any population can be bred again from the same parents, including
+// after resuming a session.
+func generationRand(seed int64, generation int) *rand.Rand {
+	return rand.New(rand.NewSource(seed ^ int64(generation)*0x5851f42d4c957f2d))
+}
 
-		i++
+// stateRand returns the random source for a change made by hand to state,
+// a population bred from seed. It depends on the seed and on the pictures in
+// state, so the change comes out the same when a session is replayed, while
+// changing the changed population again draws other numbers.
+func stateRand(seed int64, state *generationState) *rand.Rand {
+	h := fnv.New64a()
+	for _, p := range state.pictures {
+		if p.lineage != nil {
+			h.Write([]byte(p.lineage.ID))
+		} else {
+			h.Write([]byte(p.String()))
+		}
 	}
+	return generationRand(seed^int64(h.Sum64()), state.generation)
+}
 
-	for _, pic := range newPics {
-		r := rand.Intn(8)
-		for i := 0; i < r; i++ {
-			pic.Mutate()
+// evolve breeds a new population from survivors using rng and the given
+// crossover strategy. The children are born in the given generation.
+// The first elites survivors come first, unchanged. Given weights, both
+// parents of every child are picked with probability proportional to their
+// weight; otherwise every survivor parents at least one child. Children
+// that fail the quality gate or duplicate a survivor or an earlier sibling
+// are bred again while the retry budgets last.
+func evolve(rng *rand.Rand, survivors []*picture, weights []int, generation int, strategy crossover) []*picture {
+	newPics := make([]*picture, numPics)
+	kept := elites
+	if kept > len(survivors) {
+		kept = len(survivors)
+	}
+	if kept > numPics {
+		kept = numPics
+	}
+	for i, survivor := range survivors[:kept] {
+		newPics[i] = carryOver(rng, survivor, generation)
+	}
+	var seen fingerprints
+	if duplicateDistance >= 0 {
+		for _, survivor := range survivors {
+			seen.add(survivor)
 		}
 	}
+	pickParent := func() *picture {
+		if weights == nil {
+			return survivors[rng.Intn(len(survivors))]
+		}
+		return survivors[roulette(rng, weights)]
+	}
+	duplicatesLeft, failuresLeft := duplicateRetries, qualityRetries
+	for i := kept; i < len(newPics); i++ {
+		var a *picture
+		if weights == nil && i < len(survivors) {
+			a = survivors[i]
+		} else {
+			a = pickParent()
+		}
+		var child *picture
+		for {
+			child = breed(rng, a, pickParent(), strategy)
+			if failuresLeft > 0 && !measureQuality(child).ok() {
+				failuresLeft--
+				continue
+			}
+			if duplicateDistance >= 0 {
+				f := fingerprintOf(child)
+				if duplicatesLeft > 0 && seen.contains(f) {
+					duplicatesLeft--
+					continue
+				}
+				seen = append(seen, f)
+			}
+			break
+		}
+		child.lineage.Generation = generation
+		child.finishLineage()
+		newPics[i] = child
+	}
 	return newPics
 }
 
-func (p *picture) Mutate() {
-	r := rand.Intn(3)
-	var nodeToMutate Node
-
-	switch r {
-	case 0:
-		nodeToMutate = p.r
-	case 1:
-		nodeToMutate = p.g
-	case 2:
-		nodeToMutate = p.b
+// roulette picks an index with probability proportional to its weight.
+// The weights must add up to more than 0.
+func roulette(rng *rand.Rand, weights []int) int {
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+	r := rng.Intn(total)
+	for i, w := range weights {
+		if r < w {
+			return i
+		}
+		r -= w
 	}
+	return len(weights) - 1
+}
 
-	count := nodeToMutate.NodeCount()
-	r = rand.Intn(count)
+// carryOver returns a copy of p that is born in generation unchanged.
+func carryOver(rng *rand.Rand, p *picture, generation int) *picture {
+	c := p.copy()
+	c.beginLineage(rng, generation, p)
+	c.record("elite")
+	c.finishLineage()
+	return c
+}
 
-	nodeToMutate, count = GetNthNode(nodeToMutate, r, 0)
-	mutation := Mutate(nodeToMutate)
+// breed crosses a and b, or only copies a in mutants only mode, and mutates
+// the child. Mutants always get at least one mutation.
+func breed(rng *rand.Rand, a, b *picture, strategy crossover) *picture {
+	var pic *picture
+	r := 0
+	if mutantsOnly {
+		pic = a.copy()
+		pic.beginLineage(rng, 0, a)
+		if r = mutationCount(rng); r == 0 {
+			r = 1
+		}
+	} else {
+		pic = strategy.breed(rng, a, b)
+		r = mutationCount(rng)
+	}
+	for i := 0; i < r; i++ {
+		pic.Mutate(rng)
+	}
+	if pic.isPalette() {
+		if rng.Intn(stopMutationChance) == 0 {
+			pic.mutateStops(rng)
+			pic.record("mutate stops")
+		}
+	} else if rng.Intn(colorSpaceMutationChance) == 0 {
+		pic.space = ColorSpace(rng.Intn(int(NumColorSpaces)))
+		pic.record("space %s", pic.space)
+	}
+	return pic
+}
 
-	if nodeToMutate == p.r {
-		p.r = mutation
-	} else if nodeToMutate == p.g {
-		p.g = mutation
-	} else if nodeToMutate == p.b {
-		p.b = mutation
+// Mutate applies a random mutation kind to a random channel of p, trimming
+// the channel if it grows past the limits. Kinds that do not apply to the
+// tree, like jitter on a tree without constants, fall back to a point
+// mutation. With shrinkBias set, half of the mutations collapse an op into
+// one of its children instead.
+func (p *picture) Mutate(rng *rand.Rand) {
+	channelIndex, channel := p.pickRandomColor(rng)
+
+	kind := pickMutation(rng)
+	if shrinkBias && rng.Intn(2) == 0 {
+		kind = findMutation("collapse")
 	}
+	root, at, ok := kind.apply(rng, *channel)
+	if !ok {
+		kind = findMutation("point")
+		root, at, _ = kind.apply(rng, *channel)
+	}
+	*channel = Limit(rng, root, maxDepth, maxNodes)
+	p.record("%s %s[%d]", kind.name, channelNames[channelIndex], at)
 }
 
 func clear(pixels []byte) {
@@ -178,44 +430,78 @@ func setPixel(x, y int, c rgba, pixels []byte) {
 	}
 }
 
-func pixelsToTexture(renderer *sdl.Renderer, pixels []byte, w, h int) *sdl.Texture {
-	tex, err := renderer.CreateTexture(sdl.PIXELFORMAT_ABGR8888, sdl.TEXTUREACCESS_STREAMING, int32(w), int32(h))
-	if err != nil {
-		panic(err)
+type compiledPicture struct {
+	r, g, b   *Program
+	space     ColorSpace
+	ramp      []noise.Color
+	nonFinite nonFinite
+}
+
+func compilePicture(pic *picture) *compiledPicture {
+	pic = pic.simplified()
+	if pic.isPalette() {
+		return &compiledPicture{r: Compile(pic.r, pic.mode), ramp: gradientRamp(pic.stops), nonFinite: nonFiniteColor}
 	}
-	tex.Update(nil, pixels, w*4)
-	return tex
+	return &compiledPicture{Compile(pic.r, pic.mode), Compile(pic.g, pic.mode), Compile(pic.b, pic.mode), pic.space, nil, nonFiniteColor}
 }
 
-func ASTToPixels(pic *picture, w, h int) []byte {
-	scale := float32(255 / 2)
-	offset := float32(-1.0 * scale)
-	pixels := make([]byte, w*h*4)
-	pixelIndex := 0
-	for yi := 0; yi < h; yi++ {
+// renderRows fills rows y0 up to y1 of a w x h RGBA pixel buffer with the
+// picture at time t.
+func (c *compiledPicture) renderRows(pixels []byte, w, h, y0, y1 int, t float32) {
+	rStack := c.r.NewRowStack(w)
+	rRow, gRow, bRow := make([]float32, w), make([]float32, w), make([]float32, w)
+	var gStack, bStack [][]float32
+	if c.ramp == nil && c.space != Gray {
+		gStack, bStack = c.g.NewRowStack(w), c.b.NewRowStack(w)
+	}
+
+	xs := make([]float32, w)
+	for xi := range xs {
+		xs[xi] = float32(xi)/float32(w)*2 - 1
+	}
+
+	pixelIndex := y0 * w * 4
+	for yi := y0; yi < y1; yi++ {
 
 		y := float32(yi)/float32(h)*2 - 1
 
+		c.r.EvalRow(rStack, xs, y, t, rRow)
+		c.nonFinite.replace(rRow)
+		if c.ramp != nil {
+			for xi := 0; xi < w; xi++ {
+				color := c.ramp[rampIndex(rRow[xi])]
+				pixels[pixelIndex], pixels[pixelIndex+1], pixels[pixelIndex+2] = color.R, color.G, color.B
+				pixelIndex += 4
+			}
+			continue
+		}
+		if c.space != Gray {
+			c.g.EvalRow(gStack, xs, y, t, gRow)
+			c.b.EvalRow(bStack, xs, y, t, bRow)
+			c.nonFinite.replace(gRow)
+			c.nonFinite.replace(bRow)
+		}
+
 		for xi := 0; xi < w; xi++ {
-			x := float32(xi)/float32(w)*2 - 1
-
-			r := pic.r.Eval(x, y)
-			g := pic.g.Eval(x, y)
-			b := pic.b.Eval(x, y)
-
-			pixels[pixelIndex] = byte(r*scale - offset)
-			pixelIndex++
-			pixels[pixelIndex] = byte(g*scale - offset)
-			pixelIndex++
-			pixels[pixelIndex] = byte(b*scale - offset)
-			pixelIndex++
-			pixelIndex++
+			pixels[pixelIndex], pixels[pixelIndex+1], pixels[pixelIndex+2] = toRGB(c.space, rRow[xi], gRow[xi], bRow[xi])
+			pixelIndex += 4
 		}
 	}
+}
+
+func ASTToPixels(pic *picture, w, h int) []byte {
+	return ASTToFrame(pic, w, h, 0)
+}
+
+// ASTToFrame renders pic at time t. Pictures without a T leaf look the same
+// at every t.
+func ASTToFrame(pic *picture, w, h int, t float32) []byte {
+	pixels := make([]byte, w*h*4)
+	compilePicture(pic).renderRows(pixels, w, h, 0, h, t)
 	return pixels
 }
 
-func saveTree(p *picture) {
+func saveTree(p *picture, seed int64) {
 	files, err := ioutil.ReadDir("./")
 	if err != nil {
 		panic(err)
@@ -240,184 +526,118 @@ func saveTree(p *picture) {
 		panic(err)
 	}
 	defer file.Close()
-	fmt.Fprint(file, p.String())
-}
-
-func main() {
-	sdl.LogSetAllPriority(sdl.LOG_PRIORITY_VERBOSE)
-	err := sdl.Init(sdl.INIT_EVERYTHING)
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-	defer sdl.Quit()
-
-	window, err := sdl.CreateWindow("Evim", 200, 200, int32(winWidth), int32(winHeight), sdl.WINDOW_SHOWN)
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-	defer window.Destroy()
+	fmt.Fprint(file, p.simplified().String())
 
-	renderer, err := sdl.CreateRenderer(window, -1, sdl.RENDERER_ACCELERATED)
-	if err != nil {
-		fmt.Println(err)
-		return
+	if p.lineage != nil {
+		lineageName := strconv.Itoa(biggestNumber+1) + ".lineage"
+		if err := saveGenealogy(lineageName, genealogyOf(p, seed)); err != nil {
+			panic(err)
+		}
 	}
-	defer renderer.Destroy()
-
-	sdl.SetHint(sdl.HINT_RENDER_SCALE_QUALITY, "1")
-
-	var elapsedTime float32
-	keyboardState := sdl.GetKeyboardState()
-	prevKeyBoardState := make([]uint8, len(keyboardState))
+}
 
-	rand.Seed(time.Now().UTC().UnixNano())
+// givenFlags returns the names of the flags set on the command line.
+func givenFlags(fs *flag.FlagSet) map[string]bool {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	return given
+}
 
-	picTrees := make([]*picture, numPics)
-	for i := range picTrees {
-		picTrees[i] = NewPicture()
+// runSeed returns seed if the seed flag of fs was given, 0 included, and a
+// seed from the clock otherwise.
+func runSeed(fs *flag.FlagSet, seed int64) int64 {
+	if givenFlags(fs)["seed"] {
+		return seed
 	}
+	return time.Now().UTC().UnixNano()
+}
 
-	picWidth := int(float32(winWidth/cols) * float32(.9))
-	picHeight := int(float32(winHeight/rows) * float32(.8))
+// evolutionFlags are the breeding settings shared by the evolution window
+// and evim evolve.
+type evolutionFlags struct {
+	ops, opsConfig, opWeights *string
+	opChance                  *float64
+	crossover, mutations      *string
+	mutationCount             *string
+}
 
-	pixelsChannel := make(chan pixelResult, numPics)
-	buttons := make([]*ImageButton, numPics)
-	for i := range picTrees {
-		go func(i int) {
-			pixels := ASTToPixels(picTrees[i], picWidth*2, picHeight*2)
-			pixelsChannel <- pixelResult{pixels, i}
-		}(i)
+func addEvolutionFlags(fs *flag.FlagSet) *evolutionFlags {
+	f := &evolutionFlags{}
+	f.ops = fs.String("ops", Presets[0].Name, "op set to start with: uniform, noisy, geometric, smooth or one from -ops-config")
+	f.opsConfig = fs.String("ops-config", "", "JSON file with more op sets")
+	f.opWeights = fs.String("op-weights", "", "adjust op weights of the op set, e.g. Noise=3,Floor=0")
+	f.opChance = fs.Float64("op-chance", -1, "chance that a mutation picks an op rather than a leaf (default: from the op set)")
+	fs.IntVar(&maxDepth, "max-depth", maxDepth, "deepest a channel tree may grow")
+	fs.IntVar(&maxNodes, "max-nodes", maxNodes, "most nodes a channel tree may have")
+	fs.BoolVar(&shrinkBias, "shrink", shrinkBias, "bias crossover and mutation towards smaller trees")
+	f.crossover = fs.String("crossover", subtreeCrossover.String(), "crossover strategy: subtree, channel, same-channel, size-fair or blend")
+	f.mutationCount = fs.String("mutation-count", "0-7", "mutations per child, a number or a range like 1-4")
+	fs.IntVar(&elites, "elites", elites, "number of selected pictures carried over to the next generation unchanged")
+	fs.BoolVar(&mutantsOnly, "mutants-only", mutantsOnly, "breed children by mutating a single parent, without crossover")
+	f.mutations = fs.String("mutations", "", "mutation weights, e.g. jitter=4,hoist=0 (kinds: point, arity, jitter, subtree, hoist, shrink, collapse, permute, wrap)")
+	fs.IntVar(&duplicateDistance, "dup-distance", duplicateDistance, "children differing from another in at most this many of 64 hash bits are duplicates, -1 to allow them")
+	fs.IntVar(&duplicateRetries, "dup-retries", duplicateRetries, "how many duplicate children may be bred again per generation")
+	fs.Float64Var(&minVariance, "min-variance", minVariance, "least luminance variance of a picture, to reject solid colors")
+	fs.Float64Var(&maxNonFinite, "max-nonfinite", maxNonFinite, "largest fraction of NaN or infinite values in a picture")
+	fs.Float64Var(&maxNoise, "max-noise", maxNoise, "largest high-frequency energy of a picture, about 1 for static")
+	fs.IntVar(&qualityRetries, "quality-retries", qualityRetries, "how often a failing picture is drawn again, 0 to turn the quality gate off")
+	fs.BoolVar(&protectNewPictures, "protected", protectNewPictures, "draw new pictures in protected mode, where ops never give NaN or infinities")
+	fs.Var(&nonFiniteColor, "nonfinite", "how NaN and infinite values are drawn: "+nonFiniteNames())
+	fs.BoolVar(&simplifyTrees, "simplify", simplifyTrees, "simplify trees before rendering and saving them, without changing how they look")
+	return f
+}
 
+// apply checks the parsed flags, sets up the op sets and mutation weights
+// and returns the op sets, the index of the active one and the crossover
+// strategy.
+func (f *evolutionFlags) apply() ([]OpSet, int, crossover, error) {
+	strategy, ok := parseCrossover(*f.crossover)
+	if !ok {
+		return nil, 0, strategy, fmt.Errorf("unknown crossover strategy %q", *f.crossover)
 	}
-
-	evolveButtonTex := GetSinglePixelTex(renderer, sdl.Color{255, 255, 255, 0})
-	evolveRect := sdl.Rect{int32(float32(winWidth)/2 - float32(picWidth)/2), int32(float32(winHeight) - float32(winHeight)*.10), int32(picWidth), int32(float32(picHeight) * .40)}
-	evolveButton := NewImageButton(renderer, evolveButtonTex, evolveRect, sdl.Color{255, 255, 255, 0})
-
-
-	mouseState := GetMouseState()
-	state := guiState{false, nil, nil}
-	args := os.Args
-	if len(args) > 1 {
-		fileBytes, err := ioutil.ReadFile(args[1])
-		if err != nil {
-			panic(err)
+	if *f.mutations != "" {
+		if err := setMutationWeights(*f.mutations); err != nil {
+			return nil, 0, strategy, err
 		}
+	}
+	if err := setMutationCount(*f.mutationCount); err != nil {
+		return nil, 0, strategy, err
+	}
+	if elites < 0 {
+		return nil, 0, strategy, errors.New("elites must not be negative")
+	}
+	if maxDepth < 1 || maxNodes < 1 {
+		return nil, 0, strategy, errors.New("max-depth and max-nodes must be at least 1")
+	}
+	opSets, opSetIndex, err := setupOpSets(*f.ops, *f.opsConfig, *f.opWeights, *f.opChance)
+	return opSets, opSetIndex, strategy, err
+}
 
-		fileStr := string(fileBytes)
-		pictureNode := BeginLexing(fileStr)
-		p := &picture{pictureNode.GetChildren()[0], pictureNode.GetChildren()[1], pictureNode.GetChildren()[2]}
-		pixels := ASTToPixels(p, winWidth, winHeight)
-		tex := pixelsToTexture(renderer, pixels, winWidth, winHeight)
-		state.zoom = true
-		state.zoomImage = tex
-		state.zoomTree = p
-
-	}
-
-	for {
-		frameStart := time.Now()
-
-		mouseState.Update()
-		for event := sdl.PollEvent(); event != nil; event = sdl.PollEvent() {
-			switch e := event.(type) {
-			case *sdl.QuitEvent:
-				return
-			case *sdl.TouchFingerEvent:
-				if e.Type == sdl.FINGERDOWN {
-					touchX := int(e.X * float32(winWidth))
-					touchY := int(e.Y * float32(winHeight))
-					mouseState.X = touchX
-					mouseState.Y = touchY
-					mouseState.LeftButton = true
-				}
-			}
+func main() {
+	if len(os.Args) > 1 {
+		var command func([]string) error
+		switch os.Args[1] {
+		case "render":
+			command = renderCommand
+		case "animate":
+			command = animateCommand
+		case "lineage":
+			command = lineageCommand
+		case "evolve":
+			command = evolveCommand
+		case "approximate":
+			command = approximateCommand
 		}
-
-		if !state.zoom {
-			select {
-			case pixelsAndIndex, ok := <-pixelsChannel:
-				if ok {
-					tex := pixelsToTexture(renderer, pixelsAndIndex.pixels, picWidth*2, picHeight*2)
-					xi := pixelsAndIndex.index % cols
-					yi := (pixelsAndIndex.index - xi) / cols
-					x := int32(xi * picWidth)
-					y := int32(yi * picHeight)
-					xPad := int32(float32(winWidth) * .1 / float32(cols+1))
-					yPad := int32(float32(winHeight) * .1 / float32(rows+1))
-					x += xPad * (int32(xi) + 1)
-					y += yPad * (int32(yi) + 1)
-					rect := &sdl.Rect{x, y, int32(picWidth), int32(picHeight)}
-					button := NewImageButton(renderer, tex, *rect, sdl.Color{255, 255, 255, 0})
-					buttons[pixelsAndIndex.index] = button
-				}
-			default:
-			}
-
-			renderer.Clear()
-			for i, button := range buttons {
-				if button != nil {
-					button.Update(&mouseState)
-					if button.WasLeftClicked {
-						button.IsSelected = !button.IsSelected
-					} else if button.WasRightClicked {
-						zoomPixels := ASTToPixels(picTrees[i], winWidth*2, winHeight*2)
-						zoomTex := pixelsToTexture(renderer, zoomPixels, winWidth*2, winHeight*2)
-						state.zoomImage = zoomTex
-						state.zoomTree = picTrees[i]
-						state.zoom = true
-					}
-					button.Draw(renderer)
-				}
+		if command != nil {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
 			}
-			evolveButton.Update(&mouseState)
-			if evolveButton.WasLeftClicked {
-				selectedPictures := make([]*picture, 0)
-				for i, button := range buttons {
-					if button.IsSelected {
-						selectedPictures = append(selectedPictures, picTrees[i])
-					}
-				}
-				if len(selectedPictures) != 0 {
-					for i := range buttons {
-						buttons[i] = nil
-					}
-					picTrees = evolve(selectedPictures)
-					for i := range picTrees {
-						go func(i int) {
-							pixels := ASTToPixels(picTrees[i], picWidth*2, picHeight*2)
-							pixelsChannel <- pixelResult{pixels, i}
-						}(i)
-					}
-				}
-			}
-			evolveButton.Draw(renderer)
-		} else {
-			if !mouseState.RightButton && mouseState.PrevRightButton {
-				state.zoom = false
-			}
-			if keyboardState[sdl.SCANCODE_S] == 0 && prevKeyBoardState[sdl.SCANCODE_S] != 0 {
-				saveTree(state.zoomTree)
-			}
-			renderer.Copy(state.zoomImage, nil, nil)
-		}
-		renderer.Present()
-		if keyboardState[sdl.SCANCODE_ESCAPE] != 0 {
 			return
 		}
-
-		for i, v := range keyboardState {
-			prevKeyBoardState[i] = v
-		}
-
-		elapsedTime = float32(time.Since(frameStart).Seconds())
-		if elapsedTime < 5 {
-			sdl.Delay(5 - uint32(elapsedTime))
-			elapsedTime = float32(time.Since(frameStart).Seconds() * 1000)
-		}
-
 	}
 
+	evolutionWindow()
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	. "ast"
+)
+
+// mutationKind is one way picture.Mutate can change a channel tree, drawn
+// with probability proportional to its weight.
+type mutationKind struct {
+	name   string
+	apply  Mutation
+	weight float64
+}
+
+var mutations = []*mutationKind{
+	{"point", PointMutation, 4},
+	{"arity", SameArityMutation, 2},
+	{"jitter", JitterConstant, 2},
+	{"subtree", ReplaceSubtree, 1},
+	{"hoist", Hoist, 0.5},
+	{"shrink", Shrink, 1},
+	{"collapse", Collapse, 1},
+	{"permute", Permute, 1},
+	{"wrap", WrapInUnary, 1},
+}
+
+// Every child gets between minMutations and maxMutations mutations.
+var minMutations, maxMutations = 0, 7
+
+// setMutationCount sets the number of mutations per child from a count
+// like "3" or a range like "1-4".
+func setMutationCount(s string) error {
+	parts := strings.SplitN(s, "-", 2)
+	min, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return fmt.Errorf("invalid mutation count %q, want a number or a range like 1-4", s)
+	}
+	max := min
+	if len(parts) == 2 {
+		if max, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil {
+			return fmt.Errorf("invalid mutation count %q, want a number or a range like 1-4", s)
+		}
+	}
+	if min < 0 || max < min {
+		return fmt.Errorf("invalid mutation count range %q", s)
+	}
+	minMutations, maxMutations = min, max
+	return nil
+}
+
+// mutationCount draws the number of mutations for a child.
+func mutationCount(rng *rand.Rand) int {
+	return minMutations + rng.Intn(maxMutations-minMutations+1)
+}
+
+// setMutationWeights changes mutation weights from a list like
+// "jitter=4,hoist=0".
+func setMutationWeights(s string) error {
+	weights, err := parseWeights(s)
+	if err != nil {
+		return err
+	}
+	for name, w := range weights {
+		kind := findMutation(name)
+		if kind == nil {
+			return fmt.Errorf("unknown mutation %q", name)
+		}
+		if w < 0 {
+			return fmt.Errorf("negative weight for mutation %s", name)
+		}
+		kind.weight = w
+	}
+	return checkMutationWeights()
+}
+
+// checkMutationWeights fails if no mutation kind can be picked.
+func checkMutationWeights() error {
+	for _, kind := range mutations {
+		if kind.weight > 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("every mutation has weight 0")
+}
+
+func findMutation(name string) *mutationKind {
+	for _, kind := range mutations {
+		if kind.name == name {
+			return kind
+		}
+	}
+	return nil
+}
+
+// pickMutation draws a mutation kind according to the weights.
+func pickMutation(rng *rand.Rand) *mutationKind {
+	total := 0.0
+	for _, kind := range mutations {
+		total += kind.weight
+	}
+	r := rng.Float64() * total
+	var picked *mutationKind
+	for _, kind := range mutations {
+		if kind.weight <= 0 {
+			continue
+		}
+		picked = kind
+		if r < kind.weight {
+			break
+		}
+		r -= kind.weight
+	}
+	return picked
+}
@@ -0,0 +1,14 @@
+//go:build nogui
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// evolutionWindow stands in for the window in builds without SDL.
+func evolutionWindow() {
+	fmt.Fprintln(os.Stderr, "evim was built without the evolution window (-tags nogui); use evim render, animate, lineage, evolve or approximate")
+	os.Exit(1)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	. "ast"
+)
+
+// loadOpSets reads a JSON array of op sets such as
+//
+//	[{"name": "stripes", "opChance": 0.9, "weights": {"Sin": 5, "Noise": 0}}]
+func loadOpSets(path string) ([]OpSet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sets []OpSet
+	if err := json.Unmarshal(data, &sets); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, s := range sets {
+		if s.Name == "" {
+			return nil, fmt.Errorf("%s: op set without a name", path)
+		}
+		if err := s.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return sets, nil
+}
+
+// parseWeights parses a list like "Noise=3,Floor=0".
+func parseWeights(s string) (map[string]float64, error) {
+	weights := make(map[string]float64)
+	for _, field := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid op weight %q, want name=weight", field)
+		}
+		w, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid op weight %q", field)
+		}
+		weights[parts[0]] = w
+	}
+	return weights, nil
+}
+
+// setupOpSets builds the list of op sets the O key cycles through, the
+// presets followed by those in configPath, and activates the one called
+// name. Weights and an opChance of 0 or more adjust the chosen set and are
+// kept as a separate set named after it. The index of the active set is
+// returned.
+func setupOpSets(name, configPath, weights string, opChance float64) ([]OpSet, int, error) {
+	sets := append([]OpSet(nil), Presets...)
+	if configPath != "" {
+		loaded, err := loadOpSets(configPath)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, s := range loaded {
+			if i := findOpSet(sets, s.Name); i >= 0 {
+				sets[i] = s
+			} else {
+				sets = append(sets, s)
+			}
+		}
+	}
+
+	current := findOpSet(sets, name)
+	if current < 0 {
+		return nil, 0, fmt.Errorf("unknown op set %q", name)
+	}
+	if weights != "" || opChance >= 0 {
+		custom := sets[current]
+		custom.Name += "*"
+		custom.Weights = make(map[string]float64)
+		for op, w := range sets[current].Weights {
+			custom.Weights[op] = w
+		}
+		if weights != "" {
+			extra, err := parseWeights(weights)
+			if err != nil {
+				return nil, 0, err
+			}
+			for op, w := range extra {
+				custom.Weights[op] = w
+			}
+		}
+		if opChance >= 0 {
+			custom.OpChance = opChance
+		}
+		sets = append(sets, custom)
+		current = len(sets) - 1
+	}
+	if err := SetOpSet(sets[current]); err != nil {
+		return nil, 0, err
+	}
+	return sets, current, nil
+}
+
+// useOpSet returns sets with s in place of the set of the same name, or
+// added to the end, and the index of s.
+func useOpSet(sets []OpSet, s OpSet) ([]OpSet, int) {
+	if i := findOpSet(sets, s.Name); i >= 0 {
+		sets[i] = s
+		return sets, i
+	}
+	return append(sets, s), len(sets)
+}
+
+func findOpSet(sets []OpSet, name string) int {
+	for i, s := range sets {
+		if s.Name == name {
+			return i
+		}
+	}
+	return -1
+}
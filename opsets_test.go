@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	. "ast"
+)
+
+func TestLoadOpSetsDefaultsOpChance(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "opsets.json")
+	config := `[{"name": "stripes", "weights": {"Sin": 5}}, {"name": "leafy", "opChance": 0}]`
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sets, err := loadOpSets(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sets) != 2 {
+		t.Fatalf("loaded %d op sets, want 2", len(sets))
+	}
+	if sets[0].OpChance != DefaultOpChance {
+		t.Errorf("%s has op chance %v, want the default %v", sets[0].Name, sets[0].OpChance, DefaultOpChance)
+	}
+	if sets[0].Weights["Sin"] != 5 {
+		t.Errorf("%s has weights %v, want Sin=5", sets[0].Name, sets[0].Weights)
+	}
+	if sets[1].OpChance != 0 {
+		t.Errorf("%s has op chance %v, want 0 as given", sets[1].Name, sets[1].OpChance)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+
+	. "ast"
+	noise "github.com/Go_Projects/simplex_noise"
+)
+
+const maxStops = 8
+
+func randomStop(rng *rand.Rand) GradientStop {
+	return GradientStop{Pos: rng.Float32(), R: byte(rng.Intn(256)), G: byte(rng.Intn(256)), B: byte(rng.Intn(256))}
+}
+
+// randomStops makes a gradient of two to four colors that spans the whole
+// range of the scalar tree.
+func randomStops(rng *rand.Rand) []GradientStop {
+	stops := make([]GradientStop, 2+rng.Intn(3))
+	for i := range stops {
+		stops[i] = randomStop(rng)
+	}
+	stops[0].Pos = 0
+	stops[len(stops)-1].Pos = 1
+	return stops
+}
+
+// crossStops takes the stops of a below a random cut point and those of b
+// above it. If that leaves fewer than two stops, a's gradient is kept.
+func crossStops(rng *rand.Rand, a, b []GradientStop) []GradientStop {
+	cut := rng.Float32()
+	child := make([]GradientStop, 0, len(a)+len(b))
+	for _, stop := range a {
+		if stop.Pos < cut {
+			child = append(child, stop)
+		}
+	}
+	for _, stop := range b {
+		if stop.Pos >= cut && len(child) < maxStops {
+			child = append(child, stop)
+		}
+	}
+	if len(child) < 2 {
+		return a
+	}
+	return child
+}
+
+// mutateStops recolors, moves, adds or removes one stop of a palette
+// picture's gradient.
+func (p *picture) mutateStops(rng *rand.Rand) {
+	i := rng.Intn(len(p.stops))
+	switch rng.Intn(4) {
+	case 0:
+		p.stops[i].R = jitterByte(rng, p.stops[i].R)
+		p.stops[i].G = jitterByte(rng, p.stops[i].G)
+		p.stops[i].B = jitterByte(rng, p.stops[i].B)
+	case 1:
+		pos := p.stops[i].Pos + float32(rng.NormFloat64()*0.1)
+		if pos < 0 {
+			pos = 0
+		} else if pos > 1 {
+			pos = 1
+		}
+		p.stops[i].Pos = pos
+	case 2:
+		if len(p.stops) < maxStops {
+			p.stops = append(p.stops, randomStop(rng))
+		}
+	case 3:
+		if len(p.stops) > 2 {
+			p.stops = append(p.stops[:i], p.stops[i+1:]...)
+		}
+	}
+}
+
+func jitterByte(rng *rand.Rand, b byte) byte {
+	v := int(b) + int(rng.NormFloat64()*32)
+	if v < 0 {
+		return 0
+	} else if v > 255 {
+		return 255
+	}
+	return byte(v)
+}
+
+// gradientRamp expands stops into the 256 entry color ramp of
+// simplex_noise. Values before the first stop or after the last take that
+// stop's color.
+func gradientRamp(stops []GradientStop) []noise.Color {
+	sorted := append([]GradientStop(nil), stops...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Pos < sorted[j].Pos })
+	ramp := make([]noise.Stop, len(sorted))
+	for i, stop := range sorted {
+		ramp[i] = noise.Stop{Pos: stop.Pos, Color: noise.Color{R: stop.R, G: stop.G, B: stop.B}}
+	}
+	return noise.GetStopGradient(ramp)
+}
+
+// rampIndex maps a scalar tree value in [-1, 1] onto a gradientRamp entry.
+// Unlike noise.RescaleAndDraw it rounds to the nearest entry and works on
+// a row at a time, so tiles can be rendered on their own.
+func rampIndex(v float32) int {
+	return int(unit(v)*255 + 0.5)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// protectNewPictures makes new random pictures evaluate in protected mode.
+// Children keep the mode of the parent they are copied from.
+var protectNewPictures = false
+
+// nonFinite says which channel value NaN and infinite tree outputs are
+// drawn as, before the value is turned into a color. With keep set they are
+// left to the color space.
+type nonFinite struct {
+	name                string
+	keep                bool
+	nan, posInf, negInf float32
+}
+
+// nonFiniteColors are the choices for --nonfinite. The default draws them
+// the way pictures have always looked on amd64: black in RGB, while the
+// other color spaces and palettes treat NaN as the low end of a channel and
+// clamp infinities.
+var nonFiniteColors = []nonFinite{
+	{"default", true, 0, 0, 0},
+	{"black", false, -1, -1, -1},
+	{"white", false, 1, 1, 1},
+	{"gray", false, 0, 0, 0},
+	{"clamp", false, 0, 1, -1},
+}
+
+var nonFiniteColor = nonFiniteColors[0]
+
+func nonFiniteNames() string {
+	names := make([]string, len(nonFiniteColors))
+	for i, m := range nonFiniteColors {
+		names[i] = m.name
+	}
+	return strings.Join(names, ", ")
+}
+
+func (m *nonFinite) String() string {
+	return m.name
+}
+
+func (m *nonFinite) Set(s string) error {
+	for _, choice := range nonFiniteColors {
+		if choice.name == s {
+			*m = choice
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown non-finite color %q, want one of %s", s, nonFiniteNames())
+}
+
+// replace swaps the NaN and infinite values in row for their channel value.
+func (m nonFinite) replace(row []float32) {
+	if m.keep {
+		return
+	}
+	for i, v := range row {
+		if v != v {
+			row[i] = m.nan
+		} else if v > math.MaxFloat32 {
+			row[i] = m.posInf
+		} else if v < -math.MaxFloat32 {
+			row[i] = m.negInf
+		}
+	}
+}
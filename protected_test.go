@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+var (
+	nan    = float32(math.NaN())
+	posInf = float32(math.Inf(1))
+	negInf = float32(math.Inf(-1))
+)
+
+func TestWrapByte(t *testing.T) {
+	for _, c := range []struct {
+		v    float32
+		want byte
+	}{
+		{-1, 0},
+		{-0.5, 63},
+		{0, 127},
+		{1, 254},
+		{1.5, 61},
+		{-2, 129},
+		{1e9, 0},
+		{nan, 0},
+		{posInf, 0},
+		{negInf, 0},
+	} {
+		if got := wrapByte(c.v); got != c.want {
+			t.Errorf("wrapByte(%v) = %d, want %d", c.v, got, c.want)
+		}
+	}
+}
+
+func TestNonFiniteColors(t *testing.T) {
+	want := map[string][3]float32{
+		"black": {-1, -1, -1},
+		"white": {1, 1, 1},
+		"gray":  {0, 0, 0},
+		"clamp": {0, 1, -1},
+	}
+	for _, m := range nonFiniteColors {
+		row := []float32{nan, posInf, negInf, 0.25, -1, math.MaxFloat32}
+		m.replace(row)
+		finite := []float32{0.25, -1, math.MaxFloat32}
+		if m.keep {
+			if row[0] == row[0] || row[1] != posInf || row[2] != negInf {
+				t.Errorf("%s changed the non-finite values to %v", m.name, row[:3])
+			}
+		} else if colors, ok := want[m.name]; !ok {
+			t.Errorf("no test for %s", m.name)
+		} else {
+			for i, v := range colors {
+				if row[i] != v {
+					t.Errorf("%s draws %v as %v, want %v", m.name, []float32{nan, posInf, negInf}[i], row[i], v)
+				}
+			}
+		}
+		for i, v := range finite {
+			if row[3+i] != v {
+				t.Errorf("%s changed finite %v to %v", m.name, v, row[3+i])
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math"
+
+	. "ast"
+)
+
+// The quality gate turns away pictures that are nearly a solid color, are
+// mostly NaN or infinite, or are mostly static. New pictures are drawn
+// again up to qualityRetries times each, and children bred again while a
+// per generation budget of qualityRetries lasts. qualityRetries of 0 turns
+// the gate off.
+var minVariance = 25.0
+var maxNonFinite = 0.5
+var maxNoise = 0.6
+var qualityRetries = 16
+
+// previewW x previewH is the size of the render the gate measures.
+const previewW, previewH = 48, 27
+
+// quality holds the measurements of a picture's preview. variance is the
+// variance of its luminance, nonFinite the fraction of channel values that
+// are NaN or infinite, and noise the energy in differences between
+// neighboring pixels relative to the variance, which is about 1 for static
+// and near 0 for smooth pictures.
+type quality struct {
+	variance  float64
+	nonFinite float64
+	noise     float64
+}
+
+func measureQuality(p *picture) quality {
+	var q quality
+	values, nonFinite := 0, 0
+	xs := make([]float32, previewW)
+	for xi := range xs {
+		xs[xi] = float32(xi)/previewW*2 - 1
+	}
+	row := make([]float32, previewW)
+	for _, channel := range p.channels() {
+		if p.space == Gray && channel != &p.r {
+			continue
+		}
+		program := Compile(*channel, p.mode)
+		stack := program.NewRowStack(previewW)
+		for yi := 0; yi < previewH; yi++ {
+			program.EvalRow(stack, xs, float32(yi)/previewH*2-1, 0, row)
+			for _, v := range row {
+				if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+					nonFinite++
+				}
+			}
+			values += previewW
+		}
+	}
+	q.nonFinite = float64(nonFinite) / float64(values)
+
+	pixels := ASTToPixels(p, previewW, previewH)
+	sum, sumSquares := 0.0, 0.0
+	for i := 0; i < previewW*previewH*4; i += 4 {
+		l := luminance(pixels, i)
+		sum += l
+		sumSquares += l * l
+	}
+	n := float64(previewW * previewH)
+	q.variance = sumSquares/n - (sum/n)*(sum/n)
+
+	diffs, pairs := 0.0, 0
+	for y := 0; y < previewH; y++ {
+		for x := 0; x < previewW; x++ {
+			i := (y*previewW + x) * 4
+			l := luminance(pixels, i)
+			if x+1 < previewW {
+				d := luminance(pixels, i+4) - l
+				diffs += d * d
+				pairs++
+			}
+			if y+1 < previewH {
+				d := luminance(pixels, i+previewW*4) - l
+				diffs += d * d
+				pairs++
+			}
+		}
+	}
+	if q.variance > 0 {
+		q.noise = diffs / float64(pairs) / (2 * q.variance)
+	}
+	return q
+}
+
+func (q quality) ok() bool {
+	return q.variance >= minVariance && q.nonFinite <= maxNonFinite && q.noise <= maxNoise
+}
+
+// passesQualityGate reports whether p is good enough to keep. It always
+// does when the gate is off.
+func passesQualityGate(p *picture) bool {
+	return qualityRetries == 0 || measureQuality(p).ok()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	. "ast"
+)
+
+// parseInterspersed parses flags that may appear before or after positional
+// arguments, so both "render -w 100 in.apt" and "render in.apt -w 100" work.
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	positional := make([]string, 0)
+	for {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	return positional
+}
+
+func pictureFromNode(node Node) *picture {
+	children := node.GetChildren()
+	if palette, ok := node.(*OpPalette); ok {
+		return &picture{r: children[0], stops: palette.Stops, mode: palette.Mode}
+	}
+	root := node.(*OpPicture)
+	return &picture{r: children[0], g: children[1], b: children[2], space: root.Space, mode: root.Mode}
+}
+
+func loadPicture(path string) (*picture, error) {
+	fileBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pictureNode, err := BeginLexing(string(fileBytes))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return pictureFromNode(pictureNode), nil
+}
+
+// pixelsToImage wraps a rendered RGBA buffer as an opaque image. The
+// renderer leaves alpha at zero because SDL ignores it.
+func pixelsToImage(pixels []byte, w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	copy(img.Pix, pixels)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 255
+	}
+	return img
+}
+
+func savePNG(path string, pixels []byte, w, h int) error {
+	img := pixelsToImage(pixels, w, h)
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(file, img)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func renderCommand(args []string) error {
+	fs := flag.NewFlagSet("render", flag.ExitOnError)
+	w := fs.Int("w", winWidth, "output width in pixels")
+	h := fs.Int("h", winHeight, "output height in pixels")
+	out := fs.String("o", "", "output png file (default: input name with .png extension)")
+	fs.Var(&nonFiniteColor, "nonfinite", "how NaN and infinite values are drawn: "+nonFiniteNames())
+	fs.BoolVar(&simplifyTrees, "simplify", simplifyTrees, "simplify trees before rendering and saving them, without changing how they look")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: evim render in.apt [-w width] [-h height] [-o out.png]")
+		fs.PrintDefaults()
+	}
+
+	inputs := parseInterspersed(fs, args)
+	if len(inputs) != 1 {
+		fs.Usage()
+		return errors.New("render needs exactly one .apt file")
+	}
+	if *w <= 0 || *h <= 0 {
+		return fmt.Errorf("invalid output size %dx%d", *w, *h)
+	}
+
+	in := inputs[0]
+	outPath := *out
+	if outPath == "" {
+		outPath = strings.TrimSuffix(in, filepath.Ext(in)) + ".png"
+	}
+
+	pic, err := loadPicture(in)
+	if err != nil {
+		return err
+	}
+	scheduler := newRenderScheduler(runtime.NumCPU())
+	results := make(chan pixelResult, 1)
+	scheduler.submit(context.Background(), pic, *w, *h, 0, 0, 0, true, results)
+	result := <-results
+	return savePNG(outPath, result.pixels, *w, *h)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// rowsPerTile is how many rows of a picture one worker renders at a time.
+// Tiles let a single large render, like the zoom view, use every core.
+const rowsPerTile = 16
+
+type renderJob struct {
+	ctx        context.Context
+	pic        *compiledPicture
+	w, h       int
+	t          float32
+	index      int
+	generation int
+	pixels     []byte
+	remaining  int32
+	results    chan<- pixelResult
+}
+
+type renderTask struct {
+	job    *renderJob
+	y0, y1 int
+}
+
+// renderScheduler renders pictures on a fixed pool of workers. Jobs submitted
+// with priority are always picked up before ordinary ones, so the zoom view
+// does not queue behind a screen full of thumbnails.
+type renderScheduler struct {
+	high chan renderTask
+	low  chan renderTask
+}
+
+func newRenderScheduler(workers int) *renderScheduler {
+	s := &renderScheduler{make(chan renderTask, workers), make(chan renderTask, workers)}
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+	return s
+}
+
+// submit queues pic for rendering at w x h and time t. When every tile is
+// done the pixels are sent to results tagged with index and generation.
+// Cancelling ctx drops any tiles that have not started and suppresses the
+// result. A picture without pixels is done at once.
+func (s *renderScheduler) submit(ctx context.Context, pic *picture, w, h int, t float32, index, generation int, priority bool, results chan<- pixelResult) {
+	if w <= 0 || h <= 0 {
+		go func() {
+			select {
+			case results <- pixelResult{[]byte{}, index, generation}:
+			case <-ctx.Done():
+			}
+		}()
+		return
+	}
+	numTiles := (h + rowsPerTile - 1) / rowsPerTile
+	job := &renderJob{ctx, compilePicture(pic), w, h, t, index, generation, make([]byte, w*h*4), int32(numTiles), results}
+
+	queue := s.low
+	if priority {
+		queue = s.high
+	}
+	go func() {
+		for y := 0; y < h; y += rowsPerTile {
+			y1 := y + rowsPerTile
+			if y1 > h {
+				y1 = h
+			}
+			select {
+			case queue <- renderTask{job, y, y1}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (s *renderScheduler) work() {
+	for {
+		select {
+		case task := <-s.high:
+			task.run()
+			continue
+		default:
+		}
+
+		select {
+		case task := <-s.high:
+			task.run()
+		case task := <-s.low:
+			task.run()
+		}
+	}
+}
+
+func (task renderTask) run() {
+	job := task.job
+	if job.ctx.Err() != nil {
+		return
+	}
+	job.pic.renderRows(job.pixels, job.w, job.h, task.y0, task.y1, job.t)
+	if atomic.AddInt32(&job.remaining, -1) == 0 {
+		select {
+		case job.results <- pixelResult{job.pixels, job.index, job.generation}:
+		case <-job.ctx.Done():
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	. "ast"
+)
+
+const defaultSessionPath = "evim.session"
+
+// autosavePath is where the session saved in sessionPath is rewritten after
+// every generation. It is removed on a clean exit, so finding it at startup
+// means the last run on that session crashed.
+func autosavePath(sessionPath string) string {
+	return sessionPath + ".autosave"
+}
+
+// recoveryPath returns the autosave of sessionPath if it is newer than the
+// session itself, and whether there is one.
+func recoveryPath(sessionPath string) (string, bool) {
+	autosave, err := os.Stat(autosavePath(sessionPath))
+	if err != nil {
+		return "", false
+	}
+	if saved, err := os.Stat(sessionPath); err == nil && !autosave.ModTime().After(saved.ModTime()) {
+		return "", false
+	}
+	return autosavePath(sessionPath), true
+}
+
+// session is everything needed to resume an evolution run. Pictures are
+// stored in their .apt form so session files stay readable.
+type session struct {
+	sessionIsland
+	Seed      int64 `json:"seed"`
+	Rows      int   `json:"rows"`
+	Cols      int   `json:"cols"`
+	WinWidth  int   `json:"winWidth"`
+	WinHeight int   `json:"winHeight"`
+
+	// The embedded sessionIsland is the first island and Islands are the
+	// others, so sessions from before islands still load. Island is the
+	// one that was shown.
+	Islands []sessionIsland `json:"islands,omitempty"`
+	Island  int             `json:"island,omitempty"`
+
+	// Lineage is the ancestry of every picture in the islands, so
+	// genealogies survive a resume.
+	Lineage []*lineage `json:"lineage,omitempty"`
+
+	// Settings is missing from sessions saved before it was added.
+	Settings *sessionSettings `json:"settings,omitempty"`
+}
+
+// sessionSettings are the breeding settings of a run, so that a resumed run
+// breeds the same way it did before without being given the same flags.
+type sessionSettings struct {
+	OpSet         OpSet              `json:"opSet"`
+	Mutations     map[string]float64 `json:"mutations"`
+	MutationCount string             `json:"mutationCount"`
+	MaxDepth      int                `json:"maxDepth"`
+	MaxNodes      int                `json:"maxNodes"`
+	Shrink        bool               `json:"shrink,omitempty"`
+	Crossover     string             `json:"crossover"`
+	Elites        int                `json:"elites,omitempty"`
+	MutantsOnly   bool               `json:"mutantsOnly,omitempty"`
+}
+
+func newSessionSettings(strategy crossover) *sessionSettings {
+	s := &sessionSettings{OpSet: CurrentOpSet(), Mutations: make(map[string]float64),
+		MutationCount: fmt.Sprintf("%d-%d", minMutations, maxMutations), MaxDepth: maxDepth, MaxNodes: maxNodes,
+		Shrink: shrinkBias, Crossover: strategy.String(), Elites: elites, MutantsOnly: mutantsOnly}
+	for _, kind := range mutations {
+		s.Mutations[kind.name] = kind.weight
+	}
+	return s
+}
+
+// restore brings back the saved settings, except those whose flags were
+// given on the command line in fs, and returns the crossover strategy to
+// breed with.
+func (s *sessionSettings) restore(fs *flag.FlagSet, strategy crossover) (crossover, error) {
+	given := givenFlags(fs)
+	if !given["ops"] && !given["op-weights"] && !given["op-chance"] {
+		if err := SetOpSet(s.OpSet); err != nil {
+			return strategy, err
+		}
+	}
+	if !given["mutations"] {
+		for name, w := range s.Mutations {
+			kind := findMutation(name)
+			if kind == nil {
+				continue
+			}
+			if w < 0 {
+				return strategy, fmt.Errorf("negative weight for mutation %s", name)
+			}
+			kind.weight = w
+		}
+		if err := checkMutationWeights(); err != nil {
+			return strategy, err
+		}
+	}
+	if !given["mutation-count"] {
+		if err := setMutationCount(s.MutationCount); err != nil {
+			return strategy, err
+		}
+	}
+	if !given["max-depth"] {
+		maxDepth = s.MaxDepth
+	}
+	if !given["max-nodes"] {
+		maxNodes = s.MaxNodes
+	}
+	if maxDepth < 1 || maxNodes < 1 {
+		return strategy, errors.New("max-depth and max-nodes must be at least 1")
+	}
+	if !given["shrink"] {
+		shrinkBias = s.Shrink
+	}
+	if !given["crossover"] {
+		saved, ok := parseCrossover(s.Crossover)
+		if !ok {
+			return strategy, fmt.Errorf("unknown crossover strategy %q", s.Crossover)
+		}
+		strategy = saved
+	}
+	if !given["elites"] && s.Elites >= 0 {
+		elites = s.Elites
+	}
+	if !given["mutants-only"] {
+		mutantsOnly = s.MutantsOnly
+	}
+	return strategy, nil
+}
+
+// sessionIsland is the current generation of one island.
+type sessionIsland struct {
+	Generation int      `json:"generation"`
+	Pictures   []string `json:"pictures"`
+	Weights    []int    `json:"weights"`
+	// Selected is read from sessions saved before pictures had weights,
+	// and counts as weight 1.
+	Selected []bool `json:"selected,omitempty"`
+	// IDs are the lineage IDs of Pictures.
+	IDs []string `json:"ids,omitempty"`
+}
+
+func newSessionIsland(state *generationState) sessionIsland {
+	s := sessionIsland{Generation: state.generation, Pictures: make([]string, len(state.pictures)),
+		Weights: state.weights, IDs: make([]string, len(state.pictures))}
+	for i, pic := range state.pictures {
+		s.Pictures[i] = pic.String()
+		if pic.lineage != nil {
+			s.IDs[i] = pic.lineage.ID
+		}
+	}
+	return s
+}
+
+// newSession saves the current generation of every island, with current
+// being the one shown, and the settings they are bred with.
+func newSession(seed int64, islands []*generationState, current int, strategy crossover) *session {
+	s := &session{sessionIsland: newSessionIsland(islands[0]), Seed: seed, Rows: rows, Cols: cols,
+		WinWidth: winWidth, WinHeight: winHeight, Island: current, Settings: newSessionSettings(strategy)}
+	for _, state := range islands[1:] {
+		s.Islands = append(s.Islands, newSessionIsland(state))
+	}
+	var pics []*picture
+	for _, state := range islands {
+		pics = append(pics, state.pictures...)
+	}
+	s.Lineage = ancestry(pics)
+	sort.Slice(s.Lineage, func(i, j int) bool {
+		if s.Lineage[i].Generation != s.Lineage[j].Generation {
+			return s.Lineage[i].Generation < s.Lineage[j].Generation
+		}
+		return s.Lineage[i].ID < s.Lineage[j].ID
+	})
+	return s
+}
+
+// saveSession writes s to path via a temporary file, so a crash while
+// saving never leaves a truncated session behind.
+func saveSession(path string, s *session) error {
+	data, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadSession reads a session and returns the current generation of each
+// of its islands.
+func loadSession(path string) (*session, []*generationState, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	s := &session{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if s.Rows <= 0 || s.Cols <= 0 {
+		return nil, nil, fmt.Errorf("%s: invalid %dx%d grid", path, s.Rows, s.Cols)
+	}
+	// The lineage records only join the lineage book once the whole
+	// session has loaded.
+	book := make(map[string]*lineage, len(s.Lineage))
+	for _, record := range s.Lineage {
+		book[record.ID] = record
+	}
+
+	var islands []*generationState
+	for k, island := range append([]sessionIsland{s.sessionIsland}, s.Islands...) {
+		if island.Weights == nil && island.Selected != nil {
+			island.Weights = make([]int, len(island.Selected))
+			for i, selected := range island.Selected {
+				if selected {
+					island.Weights[i] = 1
+				}
+			}
+		}
+		if len(island.Pictures) != s.Rows*s.Cols || len(island.Weights) != len(island.Pictures) {
+			return nil, nil, fmt.Errorf("%s: population of island %d does not match its %dx%d grid", path, k+1, s.Rows, s.Cols)
+		}
+		for i, weight := range island.Weights {
+			if weight < 0 || weight > maxWeight {
+				return nil, nil, fmt.Errorf("%s: island %d, picture %d: weight %d is not between 0 and %d", path, k+1, i, weight, maxWeight)
+			}
+		}
+		pics := make([]*picture, len(island.Pictures))
+		for i, str := range island.Pictures {
+			node, err := BeginLexing(str)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: island %d, picture %d: %v", path, k+1, i, err)
+			}
+			pics[i] = pictureFromNode(node)
+		}
+		for i, id := range island.IDs {
+			if i < len(pics) {
+				pics[i].lineage = book[id]
+			}
+		}
+		islands = append(islands, &generationState{island.Generation, pics, island.Weights})
+	}
+	if s.Island < 0 || s.Island >= len(islands) {
+		s.Island = 0
+	}
+	for id, record := range book {
+		lineageBook[id] = record
+	}
+	return s, islands, nil
+}
+
+// apply restores the grid, island and window settings of s.
+func (s *session) apply() {
+	rows, cols, numPics = s.Rows, s.Cols, s.Rows*s.Cols
+	numIslands = 1 + len(s.Islands)
+	if s.WinWidth > 0 && s.WinHeight > 0 {
+		winWidth, winHeight = s.WinWidth, s.WinHeight
+	}
+}
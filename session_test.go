@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRecoveryPath(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "foo.session")
+	autosave := autosavePath(path)
+	if autosave != path+".autosave" {
+		t.Fatalf("autosave of %s is %s", path, autosave)
+	}
+	if _, ok := recoveryPath(path); ok {
+		t.Fatal("recovering without an autosave")
+	}
+
+	// An autosave of a session that was never saved is recovered.
+	if err := ioutil.WriteFile(autosave, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := recoveryPath(path); !ok || got != autosave {
+		t.Fatalf("recoveryPath gives %q, %v, want %q", got, ok, autosave)
+	}
+
+	// So is one newer than the session, but not an older one.
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now.Add(-time.Minute))
+	if got, ok := recoveryPath(path); !ok || got != autosave {
+		t.Fatalf("recoveryPath gives %q, %v with a newer autosave, want %q", got, ok, autosave)
+	}
+	os.Chtimes(path, now, now.Add(time.Minute))
+	if got, ok := recoveryPath(path); ok {
+		t.Fatalf("recoveryPath gives %q with an older autosave", got)
+	}
+}
+
+func TestFailedLoadKeepsLineageBook(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.session")
+	bad := `{"rows": 1, "cols": 1, "pictures": ["( Picture X Y )"], "weights": [0],
+		"lineage": [{"id": "bad-session-record", "generation": 0, "tree": "( Picture X Y T )"}]}`
+	if err := ioutil.WriteFile(path, []byte(bad), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loadSession(path); err == nil {
+		t.Fatal("loaded a session with a broken picture")
+	}
+	if _, ok := lineageBook["bad-session-record"]; ok {
+		t.Fatal("the lineage of a session that failed to load is in the lineage book")
+	}
+}
+
+// keepSettings restores the breeding settings when the test ends.
+func keepSettings(t *testing.T) {
+	saved := newSessionSettings(subtreeCrossover)
+	t.Cleanup(func() {
+		if _, err := saved.restore(flag.NewFlagSet("test", flag.ContinueOnError), subtreeCrossover); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// breedRun breeds generations from, starting at state, always choosing the
+// same four pictures with the same weights, and returns the last
+// population.
+func breedRun(seed int64, state *generationState, generations int, strategy crossover) *generationState {
+	for state.generation < generations {
+		generation := state.generation + 1
+		pics := evolve(generationRand(seed, generation), state.pictures[:4], []int{3, 1, 2, 1}, generation, strategy)
+		state = &generationState{generation, pics, make([]int, len(pics))}
+	}
+	return state
+}
+
+func firstGeneration(seed int64) *generationState {
+	rng := generationRand(seed, 0)
+	pics := make([]*picture, numPics)
+	for i := range pics {
+		pics[i] = NewPicture(rng)
+	}
+	return &generationState{0, pics, make([]int, numPics)}
+}
+
+func treesOf(state *generationState) []string {
+	trees := make([]string, len(state.pictures))
+	for i, p := range state.pictures {
+		trees[i] = p.String()
+	}
+	return trees
+}
+
+func TestSeededRunsRepeat(t *testing.T) {
+	for c := crossover(0); c < numCrossovers; c++ {
+		t.Run(c.String(), func(t *testing.T) {
+			first := treesOf(breedRun(7, firstGeneration(7), 4, c))
+			second := treesOf(breedRun(7, firstGeneration(7), 4, c))
+			if !reflect.DeepEqual(first, second) {
+				t.Fatalf("two runs with seed 7 bred\n%v\nand\n%v", first, second)
+			}
+			if other := treesOf(breedRun(8, firstGeneration(8), 4, c)); reflect.DeepEqual(first, other) {
+				t.Fatal("runs with seeds 7 and 8 bred the same pictures")
+			}
+		})
+	}
+}
+
+func TestResumedRunsRepeat(t *testing.T) {
+	keepSettings(t)
+	for _, seed := range []int64{0, 7} {
+		want := treesOf(breedRun(seed, firstGeneration(seed), 8, sizeFairCrossover))
+
+		path := filepath.Join(t.TempDir(), "run.session")
+		halfway := breedRun(seed, firstGeneration(seed), 4, sizeFairCrossover)
+		if err := saveSession(path, newSession(seed, []*generationState{halfway}, 0, sizeFairCrossover)); err != nil {
+			t.Fatal(err)
+		}
+
+		// The resumed run gets its settings from the session, not from
+		// whatever they are now.
+		maxDepth, maxNodes = 3, 10
+		findMutation("point").weight = 0
+		s, islands, err := loadSession(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		strategy, err := s.Settings.restore(flag.NewFlagSet("test", flag.ContinueOnError), subtreeCrossover)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := treesOf(breedRun(s.Seed, islands[0], 8, strategy)); !reflect.DeepEqual(got, want) {
+			t.Fatalf("seed %d: the resumed run bred\n%v\nwant\n%v", seed, got, want)
+		}
+	}
+}
+
+func TestRestoreRejectsZeroMutationWeights(t *testing.T) {
+	keepSettings(t)
+	s := newSessionSettings(subtreeCrossover)
+	for name := range s.Mutations {
+		s.Mutations[name] = 0
+	}
+	if _, err := s.restore(flag.NewFlagSet("test", flag.ContinueOnError), subtreeCrossover); err == nil {
+		t.Fatal("restored settings where every mutation has weight 0")
+	}
+	s.Mutations["point"] = -1
+	if _, err := s.restore(flag.NewFlagSet("test", flag.ContinueOnError), subtreeCrossover); err == nil {
+		t.Fatal("restored a negative mutation weight")
+	}
+}
@@ -20,7 +20,7 @@ func clamp(min, max, v int) int {
 	return v
 }
 
-func RescaleAndDraw(min, max float32, gradient []color, noise []float32, w, h int) []byte {
+func RescaleAndDraw(min, max float32, gradient []Color, noise []float32, w, h int) []byte {
 	result := make([]byte, w*h*4)
 	scale := 255.0 / (max - min)
 	offset := min * scale
@@ -29,9 +29,9 @@ func RescaleAndDraw(min, max float32, gradient []color, noise []float32, w, h in
 		noise[i] = noise[i]*scale - offset
 		c := gradient[clamp(0, 255, int(noise[i]))]
 		p := i * 4
-		result[p] = c.r
-		result[p+1] = c.g
-		result[p+2] = c.b
+		result[p] = c.R
+		result[p+1] = c.G
+		result[p+2] = c.B
 	}
 	return result
 }
@@ -75,7 +75,7 @@ func MakeNoise(noiseType NoiseType, frequency, lacunarity, gain float32, octaves
 	/*
 		elapsedTime := time.Since(startTime).Seconds() * 1000.0
 		fmt.Println(elapsedTime)
-		gradient := getDualGradient(color{0, 0, 175}, color{80, 160, 244}, color{12, 192, 75}, color{255, 255, 255})
+		gradient := GetDualGradient(Color{0, 0, 175}, Color{80, 160, 244}, Color{12, 192, 75}, Color{255, 255, 255})
 		RescaleAndDraw(min, max, pixels, gradient, noise)*/
 }
 
@@ -87,12 +87,12 @@ func lerp(b1, b2 byte, pct float32) byte {
 	return byte((1-pct)*float32(b1) + pct*float32(b2))
 }
 
-func colorLerp(c1, c2 color, pct float32) color {
-	return color{lerp(c1.r, c2.r, pct), lerp(c1.g, c2.g, pct), lerp(c1.b, c2.b, pct)}
+func colorLerp(c1, c2 Color, pct float32) Color {
+	return Color{lerp(c1.R, c2.R, pct), lerp(c1.G, c2.G, pct), lerp(c1.B, c2.B, pct)}
 }
 
-func getGradient(c1, c2 color) []color {
-	result := make([]color, 256)
+func GetGradient(c1, c2 Color) []Color {
+	result := make([]Color, 256)
 	for i := range result {
 		pct := float32(i) / float32(255)
 		result[i] = colorLerp(c1, c2, pct)
@@ -100,8 +100,8 @@ func getGradient(c1, c2 color) []color {
 	return result
 }
 
-func getDualGradient(c1, c2, c3, c4 color) []color {
-	result := make([]color, 256)
+func GetDualGradient(c1, c2, c3, c4 Color) []Color {
+	result := make([]Color, 256)
 	for i := range result {
 		pct := float32(i) / float32(255)
 		if pct < 0.5 {
@@ -114,16 +114,45 @@ func getDualGradient(c1, c2, c3, c4 color) []color {
 	return result
 }
 
-type color struct {
-	r, g, b byte
+// Stop is a color at Pos in [0, 1] along a gradient.
+type Stop struct {
+	Pos   float32
+	Color Color
 }
 
-func setPixels(x, y int, c color, pixels []byte) {
+// GetStopGradient returns a 256 entry ramp through stops, which must be
+// sorted by Pos. Before the first stop and after the last the ramp keeps
+// that stop's color.
+func GetStopGradient(stops []Stop) []Color {
+	result := make([]Color, 256)
+	next := 0
+	for i := range result {
+		pct := float32(i) / float32(255)
+		for next < len(stops) && stops[next].Pos <= pct {
+			next++
+		}
+		if next == 0 {
+			result[i] = stops[0].Color
+		} else if next == len(stops) {
+			result[i] = stops[len(stops)-1].Color
+		} else {
+			c1, c2 := stops[next-1], stops[next]
+			result[i] = colorLerp(c1.Color, c2.Color, (pct-c1.Pos)/(c2.Pos-c1.Pos))
+		}
+	}
+	return result
+}
+
+type Color struct {
+	R, G, B byte
+}
+
+func setPixels(x, y int, c Color, pixels []byte) {
 	index := (y + x) * 4
 	if index < len(pixels)-4 && index >= 0 {
-		pixels[index] = c.r
-		pixels[index+1] = c.g
-		pixels[index+2] = c.b
+		pixels[index] = c.R
+		pixels[index+1] = c.G
+		pixels[index+2] = c.B
 	}
 }
 
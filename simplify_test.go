@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	. "ast"
+)
+
+func TestSimplifiedPicturesLookTheSame(t *testing.T) {
+	rng := generationRand(1, 0)
+	for i := 0; i < 200; i++ {
+		p := NewPicture(rng)
+		simplified := p.copy()
+		for _, channel := range simplified.channels() {
+			*channel = Simplify(*channel)
+		}
+		for _, mode := range []Mode{Standard, Protected} {
+			p.mode, simplified.mode = mode, mode
+			for _, ft := range []float32{0, 0.5} {
+				if !bytes.Equal(ASTToFrame(p, 32, 18, ft), ASTToFrame(simplified, 32, 18, ft)) {
+					t.Fatalf("%s\nsimplified to\n%s\nlooks different in %s mode at t=%v", p, simplified, mode, ft)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,589 @@
+//go:build !nogui
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/veandco/go-sdl2/sdl"
+
+	. "ast"
+	. "gui"
+)
+
+// This file is the evolution window, the only part of evim that needs SDL.
+// Build with -tags nogui for a binary that only has the commands that run
+// without a display.
+
+type guiState struct {
+	zoom           bool
+	zoomImage      *sdl.Texture
+	zoomBorrowed   bool
+	zoomTree       *picture
+	zoomGeneration int
+	zoomCtx        context.Context
+	zoomCancel     context.CancelFunc
+	playing        bool
+	playStart      time.Time
+	frames         []*sdl.Texture
+}
+
+func pixelsToTexture(renderer *sdl.Renderer, pixels []byte, w, h int) *sdl.Texture {
+	tex, err := renderer.CreateTexture(sdl.PIXELFORMAT_ABGR8888, sdl.TEXTUREACCESS_STREAMING, int32(w), int32(h))
+	if err != nil {
+		panic(err)
+	}
+	tex.Update(nil, pixels, w*4)
+	return tex
+}
+
+// evolutionWindow parses the command line and runs the evolution window
+// until it is closed.
+func evolutionWindow() {
+	sessionFlag := flag.String("session", "", "resume the evolution session saved in this file, or start one there")
+	seedFlag := flag.Int64("seed", 0, "seed for the run's random numbers (default: from the clock)")
+	settings := addEvolutionFlags(flag.CommandLine)
+	migration := addIslandFlags(flag.CommandLine)
+	flag.Parse()
+	opSets, opSetIndex, strategy, err := settings.apply()
+	if err == nil {
+		err = applyIslandFlags(*migration)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	seed := runSeed(flag.CommandLine, *seedFlag)
+	var islands []*generationState
+	island := 0
+
+	sessionPath := *sessionFlag
+	if sessionPath == "" {
+		sessionPath = defaultSessionPath
+	}
+	autosave := autosavePath(sessionPath)
+	// The session is only saved on exit to a file the user named, so that
+	// a plain run does not overwrite a session saved earlier.
+	saveOnExit := *sessionFlag != ""
+
+	resumePath := *sessionFlag
+	if recovered, ok := recoveryPath(sessionPath); ok {
+		fmt.Println("recovering the unsaved generations of", sessionPath, "from", recovered)
+		resumePath = recovered
+	}
+	if resumePath != "" {
+		// A session file that does not exist yet is where a new session
+		// is saved.
+		s, states, err := loadSession(resumePath)
+		if os.IsNotExist(err) && resumePath == *sessionFlag {
+			fmt.Println("starting a new session in", resumePath)
+		} else if err != nil {
+			fmt.Println(err)
+			return
+		} else {
+			if givenFlags(flag.CommandLine)["seed"] && s.Seed != *seedFlag {
+				fmt.Printf("using the seed %d of %s instead of --seed %d\n", s.Seed, resumePath, *seedFlag)
+			}
+			s.apply()
+			seed, islands, island = s.Seed, states, s.Island
+			if s.Settings != nil {
+				if strategy, err = s.Settings.restore(flag.CommandLine, strategy); err != nil {
+					fmt.Println(err)
+					return
+				}
+				opSets, opSetIndex = useOpSet(opSets, CurrentOpSet())
+			}
+		}
+	}
+	fmt.Println("seed", seed)
+
+	sdl.LogSetAllPriority(sdl.LOG_PRIORITY_VERBOSE)
+	err = sdl.Init(sdl.INIT_EVERYTHING)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer sdl.Quit()
+
+	window, err := sdl.CreateWindow("Evim", 200, 200, int32(winWidth), int32(winHeight), sdl.WINDOW_SHOWN)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer window.Destroy()
+
+	renderer, err := sdl.CreateRenderer(window, -1, sdl.RENDERER_ACCELERATED)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer renderer.Destroy()
+
+	sdl.SetHint(sdl.HINT_RENDER_SCALE_QUALITY, "1")
+
+	var elapsedTime float32
+	keyboardState := sdl.GetKeyboardState()
+	prevKeyBoardState := make([]uint8, len(keyboardState))
+
+	if islands == nil {
+		for k := 0; k < numIslands; k++ {
+			rng := generationRand(islandSeed(seed, k), 0)
+			pics := make([]*picture, numPics)
+			for i := range pics {
+				pics[i] = NewPicture(rng)
+			}
+			islands = append(islands, &generationState{0, pics, make([]int, numPics)})
+		}
+	}
+	// Every island keeps its own history. The one shown is hist, and its
+	// current generation is in generation, picTrees and weights.
+	histories := make([]*history, len(islands))
+	for k, state := range islands {
+		histories[k] = newHistory(state)
+	}
+	hist := histories[island]
+	generation, picTrees, weights := hist.top().generation, hist.top().pictures, hist.top().weights
+
+	picWidth := int(float32(winWidth/cols) * float32(.9))
+	picHeight := int(float32(winHeight/rows) * float32(.8))
+
+	scheduler := newRenderScheduler(runtime.NumCPU())
+	pixelsChannel := make(chan pixelResult, numPics)
+	zoomChannel := make(chan pixelResult, 1)
+	frameChannel := make(chan pixelResult, animationFrames)
+	buttons := make([]*ImageButton, numPics)
+
+	// Every batch of thumbnails gets a new generation and context, so renders
+	// still in flight for a replaced population are cancelled and any result
+	// that slips through is recognised as stale.
+	renderGeneration := 0
+	gridCtx, cancelGrid := context.WithCancel(context.Background())
+	renderGrid := func() {
+		cancelGrid()
+		gridCtx, cancelGrid = context.WithCancel(context.Background())
+		renderGeneration++
+		for i := range picTrees {
+			scheduler.submit(gridCtx, picTrees[i], picWidth*2, picHeight*2, 0, i, renderGeneration, false, pixelsChannel)
+		}
+	}
+	renderGrid()
+
+	evolveButtonTex := GetSinglePixelTex(renderer, sdl.Color{255, 255, 255, 0})
+	evolveRect := sdl.Rect{int32(float32(winWidth)/2 - float32(picWidth)/2), int32(float32(winHeight) - float32(winHeight)*.10), int32(picWidth), int32(float32(picHeight) * .40)}
+	evolveButton := NewImageButton(renderer, evolveButtonTex, evolveRect, sdl.Color{255, 255, 255, 0})
+
+	mouseState := GetMouseState()
+	state := guiState{}
+	// setZoomImage shows tex in the zoom view, destroying the texture it
+	// replaces unless that was borrowed from a thumbnail.
+	setZoomImage := func(tex *sdl.Texture, borrowed bool) {
+		if state.zoomImage != nil && !state.zoomBorrowed {
+			state.zoomImage.Destroy()
+		}
+		state.zoomImage, state.zoomBorrowed = tex, borrowed
+	}
+	// clearZoom destroys the textures of the zoomed picture.
+	clearZoom := func() {
+		setZoomImage(nil, false)
+		for _, frame := range state.frames {
+			if frame != nil {
+				frame.Destroy()
+			}
+		}
+		state.frames = nil
+	}
+	// zoomIn shows pic full screen, using placeholder, the texture of its
+	// thumbnail, until the full resolution render arrives on zoomChannel.
+	zoomIn := func(pic *picture, placeholder *sdl.Texture) {
+		state.zoomCtx, state.zoomCancel = context.WithCancel(context.Background())
+		state.zoomGeneration++
+		clearZoom()
+		setZoomImage(placeholder, true)
+		state.zoomTree = pic
+		state.zoom = true
+		state.playing = false
+		scheduler.submit(state.zoomCtx, pic, winWidth*2, winHeight*2, 0, 0, state.zoomGeneration, true, zoomChannel)
+	}
+	// playZoom animates the zoomed picture over t in [-1, 1]. Frames are
+	// rendered at window resolution and shown as soon as they arrive.
+	playZoom := func() {
+		state.playing = true
+		state.playStart = time.Now()
+		if state.frames != nil {
+			return
+		}
+		state.frames = make([]*sdl.Texture, animationFrames)
+		for i := range state.frames {
+			t := frameTime(i, animationFrames, -1, 1)
+			scheduler.submit(state.zoomCtx, state.zoomTree, winWidth, winHeight, t, i, state.zoomGeneration, true, frameChannel)
+		}
+	}
+
+	currentWeights := func() []int {
+		current := make([]int, numPics)
+		for i, button := range buttons {
+			if button != nil {
+				current[i] = button.Weight
+			} else {
+				current[i] = weights[i]
+			}
+		}
+		return current
+	}
+	currentSession := func() *session {
+		states := make([]*generationState, len(histories))
+		for k, h := range histories {
+			states[k] = h.top()
+		}
+		states[island] = &generationState{generation, picTrees, currentWeights()}
+		// Pictures in the histories can still be shown and saved, so only
+		// the lineage of the others is dropped.
+		var live []*picture
+		for _, h := range histories {
+			for _, s := range h.states {
+				live = append(live, s.pictures...)
+			}
+		}
+		pruneLineage(append(live, picTrees...))
+		return newSession(seed, states, island, strategy)
+	}
+
+	// hovered is the thumbnail under the mouse, whose size is shown in the
+	// title, or -1.
+	hovered := -1
+	updateTitle := func() {
+		breeding := strategy.String() + " crossover"
+		if mutantsOnly {
+			breeding = "mutants only"
+		}
+		title := fmt.Sprintf("Evim - generation %d (%d/%d) - ops %s - %s", generation, hist.current+1, len(hist.states), CurrentOpSet().Name, breeding)
+		if len(histories) > 1 {
+			title += fmt.Sprintf(" - island %d/%d", island+1, len(histories))
+		}
+		if hovered >= 0 {
+			depth, nodes := picTrees[hovered].size()
+			title += fmt.Sprintf(" - depth %d, %d nodes", depth, nodes)
+			if picTrees[hovered].mode == Protected {
+				title += ", protected"
+			}
+		}
+		window.SetTitle(title)
+	}
+	updateTitle()
+	// show puts the population s in the grid.
+	show := func(s *generationState) {
+		generation, picTrees, weights = s.generation, s.pictures, append([]int(nil), s.weights...)
+		for i := range buttons {
+			buttons[i] = nil
+		}
+		renderGrid()
+		updateTitle()
+	}
+	// restore shows an earlier or later generation from the history,
+	// remembering the weights given in the one being left.
+	restore := func(step func() *generationState) {
+		leaving := hist.top()
+		leaving.weights = currentWeights()
+		s := step()
+		if s == nil {
+			return
+		}
+		show(s)
+	}
+	// showIsland switches to island k, remembering the weights given in the
+	// one being left.
+	showIsland := func(k int) {
+		if k == island || k >= len(histories) {
+			return
+		}
+		hist.top().weights = currentWeights()
+		island, hist = k, histories[k]
+		show(hist.top())
+	}
+	keyReleased := func(key sdl.Scancode) bool {
+		return keyboardState[key] == 0 && prevKeyBoardState[key] != 0
+	}
+	// quit saves the session if it has a file of its own and removes the
+	// autosave, which is only kept around to recover from crashes.
+	quit := func() {
+		if saveOnExit {
+			if err := saveSession(sessionPath, currentSession()); err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+		os.Remove(autosave)
+	}
+
+	if flag.NArg() > 0 {
+		p, err := loadPicture(flag.Arg(0))
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		zoomIn(p, nil)
+	}
+
+	for {
+		frameStart := time.Now()
+
+		mouseState.Update()
+		for event := sdl.PollEvent(); event != nil; event = sdl.PollEvent() {
+			switch e := event.(type) {
+			case *sdl.QuitEvent:
+				quit()
+				return
+			case *sdl.TouchFingerEvent:
+				if e.Type == sdl.FINGERDOWN {
+					touchX := int(e.X * float32(winWidth))
+					touchY := int(e.Y * float32(winHeight))
+					mouseState.X = touchX
+					mouseState.Y = touchY
+					mouseState.LeftButton = true
+				}
+			}
+		}
+
+		select {
+		case pixelsAndIndex := <-pixelsChannel:
+			if pixelsAndIndex.generation == renderGeneration {
+				tex := pixelsToTexture(renderer, pixelsAndIndex.pixels, picWidth*2, picHeight*2)
+				xi := pixelsAndIndex.index % cols
+				yi := (pixelsAndIndex.index - xi) / cols
+				x := int32(xi * picWidth)
+				y := int32(yi * picHeight)
+				xPad := int32(float32(winWidth) * .1 / float32(cols+1))
+				yPad := int32(float32(winHeight) * .1 / float32(rows+1))
+				x += xPad * (int32(xi) + 1)
+				y += yPad * (int32(yi) + 1)
+				rect := &sdl.Rect{x, y, int32(picWidth), int32(picHeight)}
+				button := NewImageButton(renderer, tex, *rect, sdl.Color{255, 255, 255, 0})
+				button.Weight = weights[pixelsAndIndex.index]
+				buttons[pixelsAndIndex.index] = button
+			}
+		default:
+		}
+
+		renderer.Clear()
+		if !state.zoom {
+			prevHovered := hovered
+			hovered = -1
+			for i, button := range buttons {
+				if button != nil {
+					button.Update(&mouseState)
+					if button.IsHovered {
+						hovered = i
+					}
+					if button.WasLeftClicked {
+						// Clicks raise the weight up to maxWeight and
+						// then clear it; with shift held they lower it.
+						if keyboardState[sdl.SCANCODE_LSHIFT] != 0 || keyboardState[sdl.SCANCODE_RSHIFT] != 0 {
+							button.Weight = (button.Weight + maxWeight) % (maxWeight + 1)
+						} else {
+							button.Weight = (button.Weight + 1) % (maxWeight + 1)
+						}
+					} else if button.WasRightClicked {
+						zoomIn(picTrees[i], button.Image)
+					}
+					button.Draw(renderer)
+				}
+			}
+			if hovered != prevHovered {
+				updateTitle()
+			}
+			evolveButton.Update(&mouseState)
+			if evolveButton.WasLeftClicked {
+				// The parents are ordered by weight, so the elites are
+				// the most preferred pictures.
+				parents, parentWeights := make([]*picture, 0), make([]int, 0)
+				for weight := maxWeight; weight > 0; weight-- {
+					for i, button := range buttons {
+						if button != nil && button.Weight == weight {
+							parents = append(parents, picTrees[i])
+							parentWeights = append(parentWeights, weight)
+						}
+					}
+				}
+				if len(parents) != 0 {
+					hist.top().weights = currentWeights()
+					for i := range buttons {
+						buttons[i] = nil
+					}
+					generation++
+					rng := generationRand(islandSeed(seed, island), generation)
+					picTrees = evolve(rng, parents, parentWeights, generation, strategy)
+					weights = make([]int, numPics)
+					state := &generationState{generation, picTrees, weights}
+					if migrationDue(generation) {
+						from := (island + len(histories) - 1) % len(histories)
+						state = migrate(rng, pickMigrants(rng, histories[from].top(), migrants, migrateSelected), from, state)
+						picTrees, weights = state.pictures, state.weights
+					}
+					hist.push(state)
+					updateTitle()
+					renderGrid()
+					if err := saveSession(autosave, currentSession()); err != nil {
+						fmt.Println(err)
+					}
+				}
+			}
+			evolveButton.Draw(renderer)
+
+			if keyReleased(sdl.SCANCODE_S) {
+				if err := saveSession(sessionPath, currentSession()); err != nil {
+					fmt.Println(err)
+				} else {
+					saveOnExit = true
+				}
+			}
+			if keyReleased(sdl.SCANCODE_LEFT) {
+				restore(hist.back)
+			} else if keyReleased(sdl.SCANCODE_RIGHT) {
+				restore(hist.forward)
+			}
+			if keyReleased(sdl.SCANCODE_TAB) {
+				showIsland((island + 1) % len(histories))
+			}
+			for k, key := range []sdl.Scancode{sdl.SCANCODE_1, sdl.SCANCODE_2, sdl.SCANCODE_3, sdl.SCANCODE_4,
+				sdl.SCANCODE_5, sdl.SCANCODE_6, sdl.SCANCODE_7, sdl.SCANCODE_8, sdl.SCANCODE_9} {
+				if keyReleased(key) {
+					showIsland(k)
+				}
+			}
+			if keyReleased(sdl.SCANCODE_M) && len(histories) > 1 {
+				// M sends the selected pictures, or a few random ones if
+				// none are selected, to the next island.
+				current := &generationState{generation, picTrees, currentWeights()}
+				count := migrants
+				for _, weight := range current.weights {
+					if weight > 0 {
+						count = len(current.pictures)
+						break
+					}
+				}
+				to := (island + 1) % len(histories)
+				rng := stateRand(islandSeed(seed, to), histories[to].top())
+				sent := pickMigrants(rng, current, count, true)
+				histories[to].push(migrate(rng, sent, island, histories[to].top()))
+				fmt.Printf("sent %d pictures to island %d\n", len(sent), to+1)
+				if err := saveSession(autosave, currentSession()); err != nil {
+					fmt.Println(err)
+				}
+			}
+			if keyReleased(sdl.SCANCODE_U) {
+				mutantsOnly = !mutantsOnly
+				updateTitle()
+			}
+			if keyReleased(sdl.SCANCODE_C) {
+				strategy = (strategy + 1) % numCrossovers
+				updateTitle()
+			}
+			if keyReleased(sdl.SCANCODE_G) && hovered >= 0 {
+				// G guards the picture under the mouse against NaN and
+				// infinities by switching a copy of it to protected mode,
+				// or back. The copy takes its place in a new population,
+				// so going back in the history undoes the switch.
+				current := &generationState{generation, picTrees, currentWeights()}
+				hist.top().weights = current.weights
+				pic := current.pictures[hovered]
+				switched := pic.copy()
+				if pic.mode == Protected {
+					switched.mode = Standard
+				} else {
+					switched.mode = Protected
+				}
+				switched.beginLineage(stateRand(islandSeed(seed, island), current), generation, pic)
+				switched.record("mode %s", switched.mode)
+				switched.finishLineage()
+				picTrees = append([]*picture(nil), current.pictures...)
+				picTrees[hovered] = switched
+				// The new thumbnail replaces the button, which takes its
+				// weight from weights.
+				weights = append([]int(nil), current.weights...)
+				hist.push(&generationState{generation, picTrees, weights})
+				scheduler.submit(gridCtx, switched, picWidth*2, picHeight*2, 0, hovered, renderGeneration, false, pixelsChannel)
+				updateTitle()
+				if err := saveSession(autosave, currentSession()); err != nil {
+					fmt.Println(err)
+				}
+			}
+			if keyReleased(sdl.SCANCODE_O) {
+				opSetIndex = (opSetIndex + 1) % len(opSets)
+				if err := SetOpSet(opSets[opSetIndex]); err != nil {
+					fmt.Println(err)
+				}
+				updateTitle()
+			}
+		} else {
+			select {
+			case zoomResult := <-zoomChannel:
+				if zoomResult.generation == state.zoomGeneration {
+					setZoomImage(pixelsToTexture(renderer, zoomResult.pixels, winWidth*2, winHeight*2), false)
+				}
+			default:
+			}
+			for received := true; received; {
+				select {
+				case frame := <-frameChannel:
+					if frame.generation == state.zoomGeneration && state.frames != nil {
+						state.frames[frame.index] = pixelsToTexture(renderer, frame.pixels, winWidth, winHeight)
+					}
+				default:
+					received = false
+				}
+			}
+
+			if keyReleased(sdl.SCANCODE_P) {
+				if state.playing {
+					state.playing = false
+				} else {
+					playZoom()
+				}
+			}
+			if !mouseState.RightButton && mouseState.PrevRightButton {
+				state.zoomCancel()
+				state.zoom = false
+				clearZoom()
+			}
+			if keyReleased(sdl.SCANCODE_S) {
+				saveTree(state.zoomTree, seed)
+			}
+			tex := state.zoomImage
+			if state.playing {
+				// Hold the latest frame that is ready while later ones render.
+				frame := int(time.Since(state.playStart).Seconds()*animationFPS) % animationFrames
+				for i := frame; i >= 0; i-- {
+					if state.frames[i] != nil {
+						tex = state.frames[i]
+						break
+					}
+				}
+			}
+			if tex != nil {
+				renderer.Copy(tex, nil, nil)
+			}
+		}
+		renderer.Present()
+		if keyboardState[sdl.SCANCODE_ESCAPE] != 0 {
+			quit()
+			return
+		}
+
+		for i, v := range keyboardState {
+			prevKeyBoardState[i] = v
+		}
+
+		elapsedTime = float32(time.Since(frameStart).Seconds())
+		if elapsedTime < 5 {
+			sdl.Delay(5 - uint32(elapsedTime))
+			elapsedTime = float32(time.Since(frameStart).Seconds() * 1000)
+		}
+
+	}
+}